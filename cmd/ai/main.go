@@ -4,29 +4,20 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"github.com/joho/godotenv"
+	"os"
+	"os/signal"
 	"pocket_guide/pkg/ai"
-	"pocket_guide/pkg/broker"
+	"pocket_guide/pkg/config"
 	"pocket_guide/pkg/logging"
+	"pocket_guide/pkg/metrics"
+	"syscall"
 )
 
-// Loading values from .env into the system
-func init() {
-	var log logging.Log
-	log.NewLog("logs/ai/")
-
-	err := godotenv.Load("cfg/.env")
-	if err != nil {
-		log.LogFatal.Fatal("init(): Cannot read env vars, bot have been stopped, error: ", err)
-	} else {
-		log.LogInfo.Println("init(): Env vars have been successfully loaded.")
-	}
-}
-
 // The entry point to the program.
 // Creating a broker, listening to the message channel,
-// processing incoming messages in an infinite loop
+// processing incoming messages until SIGINT/SIGTERM.
+// On shutdown it stops consuming, waits for the running requests
+// and closes the broker, the AI client and the logger
 func main() {
 	// Logging layer
 	var log logging.Log
@@ -34,69 +25,72 @@ func main() {
 	defer log.Close()
 	var err error
 
-	// Channel to connect main() with consumer goroutine
-	ch := make(chan broker.UserMsg)
+	// Configuration from cfg/.cfg, cfg/.env and env variables
+	var cfg config.Config
+	err = cfg.Load(config.PartAi | config.PartAmqp)
+	if err != nil {
+		log.Fatal("main(): Invalid configuration", "err", err)
+	}
+	logging.Setup(cfg.Log)
+	log.Info("main(): Configuration has been successfully loaded")
+
+	// Context cancelled by the termination signals
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Creating broker
 	var a ai.Ai
-	err = a.NewAi()
+	err = a.NewAi(&cfg)
 	if err != nil {
-		log.LogFatal.Fatal("main(): Unable to create ai object, error: ", err)
+		log.Fatal("main(): Unable to create ai object", "err", err)
 	}
 	defer a.Close()
 
-	//Listening to the broker's channel in goroutine
-	go func() {
-		err = a.Consumer.Consume("aiRequest", ch)
+	// Metrics for Prometheus and the health pages for the orchestrator
+	var monitor metrics.Server
+	if cfg.Ai.MetricsListen != "" {
+		monitor.NewServer(cfg.Ai.MetricsListen)
+		monitor.Health(cfg.Health.Timeout, a.Checks()...)
+		err = monitor.Start(func(err error) {
+			log.Error("main(): Metrics server has stopped", "err", err)
+		})
 		if err != nil {
-			log.LogFatal.Fatal("main(): Cannot consume messages, error:", err)
+			log.Fatal("main(): Unable to start the metrics server", "err", err)
 		}
-	}()
-
-	// If a message is received from the broker
-	for {
-		msg, _ := <-ch
-
-		if len(msg.Data) != 0 {
-			// Creating a request for AI
-			request := a.MakeRequest(msg.Data)
-			ctx := context.Background()
-
-			//Parsing a request for AI, processing the response and publishing it in the Sender()
-			go func(msg broker.UserMsg) {
-				//Get response from AI API
-				response, err := a.Client.Chat(ctx, request)
-				if err != nil {
-					//FIXME иногда вылезает вот эта ошибка в чате
-					msg.Data = "Извините, сервис для общения с искусственным интеллектом временно не работает."
+		log.Info("main(): Metrics and health pages are served", "listen", cfg.Ai.MetricsListen)
+	}
 
-					data, err := json.Marshal(msg)
-					if err != nil {
-						log.LogErr.Println("main(): Unable to convert into json, error:", err)
-						return
-					}
+	// Listening to the broker's channel, messages are handled by AI_WORKERS workers
+	// and acknowledged after the answer has been published
+	consumerCtx, stopConsumer := context.WithCancel(context.Background())
+	defer stopConsumer()
+	consumerDone := make(chan error, 1)
+	go func() {
+		consumerDone <- a.Consumer.Consume("aiRequest", a.Workers(), a.Handle, consumerCtx)
+	}()
+	monitor.SetReady(true)
 
-					err = a.Producer.Publish(data, "Response", ctx)
-					if err != nil {
-						log.LogErr.Println("main(): Unable to publish message to Sender(), error:", err)
-						return
-					}
-				} else {
-					msg.Data = response.Choices[0].Message.Content
+	select {
+	case <-ctx.Done():
+		log.Info("main(): Termination signal received, shutting down")
+		// The default handling is restored, so a second signal kills the process stuck in the shutdown
+		stop()
+	case err = <-consumerDone:
+		log.Fatal("main(): Cannot consume messages", "err", err)
+	}
 
-					data, err := json.Marshal(msg)
-					if err != nil {
-						log.LogErr.Println("main(): Unable to convert into json, error:", err)
-						return
-					}
+	monitor.SetReady(false)
 
-					err = a.Producer.Publish(data, "Response", ctx)
-					if err != nil {
-						log.LogErr.Println("main(): Unable to publish message to Sender(), error:", err)
-						return
-					}
-				}
-			}(msg)
-		}
+	// No new questions, the running requests are finished before the deadline,
+	// unacknowledged ones are redelivered to the next instance
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	stopConsumer()
+	select {
+	case <-consumerDone:
+		log.Info("main(): All requests have been handled")
+	case <-shutdownCtx.Done():
+		log.Error("main(): Not all requests have been handled in time")
 	}
+	_ = monitor.Shutdown(shutdownCtx)
 }
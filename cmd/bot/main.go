@@ -3,27 +3,21 @@ package main
 // Ivan Orshak, 12.07.2023
 
 import (
-	"github.com/joho/godotenv"
+	"context"
+	"os"
+	"os/signal"
 	"pocket_guide/pkg/bot"
+	"pocket_guide/pkg/config"
 	"pocket_guide/pkg/logging"
+	"pocket_guide/pkg/metrics"
+	"syscall"
 )
 
-// Loading values from .env into the system
-func init() {
-	var log logging.Log
-	log.NewLog("logs/bot/")
-
-	err := godotenv.Load("cfg/.env")
-	if err != nil {
-		log.LogFatal.Fatal("init(): Cannot read env vars, bot have been stopped, error: ", err)
-	} else {
-		log.LogInfo.Println("init(): Env vars have been successfully loaded.")
-	}
-}
-
 // The entry point to the program, creating a bot and connecting to the telegram api,
 // launching two goroutines: listening to the telegram api for updates
-// and sending a message to the telegram api
+// and sending a message to the telegram api.
+// On SIGINT/SIGTERM the bot stops receiving updates, then stops consuming answers,
+// waits for the running handlers and closes the broker and the logger
 func main() {
 	// Logging layer
 	var log logging.Log
@@ -31,27 +25,82 @@ func main() {
 	defer log.Close()
 	var err error
 
+	// Configuration from cfg/.cfg, cfg/.env and env variables
+	var cfg config.Config
+	err = cfg.Load(config.PartBot | config.PartAmqp)
+	if err != nil {
+		log.Fatal("main(): Invalid configuration", "err", err)
+	}
+	logging.Setup(cfg.Log)
+	log.Info("main(): Configuration has been successfully loaded")
+
+	// Context cancelled by the termination signals
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Bot object
 	var b bot.Bot
 	// Creating telegram server connection
-	err = b.NewBot()
+	err = b.NewBot(&cfg)
 	if err != nil {
-		log.LogFatal.Fatal("main(): Unable to create a new bot, error: ", err)
+		log.Fatal("main(): Unable to create a new bot", "err", err)
 	} else {
-		log.LogInfo.Println("main(): Bot successfully created and connected to telegram api server.")
+		log.Info("main(): Bot successfully created and connected to telegram api server")
 	}
 	defer b.Close()
 
+	// Metrics for Prometheus and the health pages for the orchestrator
+	var monitor metrics.Server
+	if cfg.Bot.MetricsListen != "" {
+		monitor.NewServer(cfg.Bot.MetricsListen)
+		monitor.Health(cfg.Health.Timeout, b.Checks()...)
+		err = monitor.Start(func(err error) {
+			log.Error("main(): Metrics server has stopped", "err", err)
+		})
+		if err != nil {
+			log.Fatal("main(): Unable to start the metrics server", "err", err)
+		}
+		log.Info("main(): Metrics and health pages are served", "listen", cfg.Bot.MetricsListen)
+	}
+
 	// Daemon for listen telegram server chanel
 	go b.Listener()
 
 	// Daemon for send our data to telegram server
-	err = b.Sender()
-	if err != nil {
-		log.LogFatal.Fatal("main(): Unable to send messages to telegram server, error: ", err)
-	} else {
-		log.LogInfo.Println("main(): Sender() has been successfully started.")
+	senderCtx, stopSender := context.WithCancel(context.Background())
+	defer stopSender()
+	senderDone := make(chan error, 1)
+	go func() {
+		senderDone <- b.Sender(senderCtx)
+	}()
+	log.Info("main(): Sender() has been successfully started")
+	monitor.SetReady(true)
+
+	select {
+	case <-ctx.Done():
+		log.Info("main(): Termination signal received, shutting down")
+		// The default handling is restored, so a second signal kills the process stuck in the shutdown
+		stop()
+	case err = <-senderDone:
+		log.Fatal("main(): Unable to send messages to telegram server", "err", err)
 	}
 
-	return
+	monitor.SetReady(false)
+
+	// Everything has to be finished before the deadline, the long polling request of the bot has to return within it
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// No new questions, the ones being handled are still published
+	_ = b.StopListener(shutdownCtx)
+
+	// No new answers, unconsumed ones stay in the queue for the next start
+	stopSender()
+	select {
+	case <-senderDone:
+		log.Info("main(): Sender() has been stopped")
+	case <-shutdownCtx.Done():
+		log.Error("main(): Sender() has not stopped in time")
+	}
+	_ = monitor.Shutdown(shutdownCtx)
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"pocket_guide/pkg/ai"
+	"pocket_guide/pkg/bot"
+	"pocket_guide/pkg/broker"
+	"pocket_guide/pkg/config"
+	"pocket_guide/pkg/logging"
+	"pocket_guide/pkg/metrics"
+	"syscall"
+)
+
+// The entry point to the program running the bot and the AI service in one process,
+// they exchange messages through the in-memory broker instead of RabbitMQ.
+// On SIGINT/SIGTERM the services are stopped gracefully like the standalone ones
+func main() {
+	// Logging layer
+	var log logging.Log
+	log.NewLog("logs/guide/")
+	defer log.Close()
+	var err error
+
+	// Configuration from cfg/.cfg, cfg/.env and env variables
+	var cfg config.Config
+	err = cfg.Load(config.PartBot | config.PartAi)
+	if err != nil {
+		log.Fatal("main(): Invalid configuration", "err", err)
+	}
+	logging.Setup(cfg.Log)
+	log.Info("main(): Configuration has been successfully loaded")
+
+	// Context cancelled by the termination signals
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// In-process broker shared by both services
+	var brk broker.MemoryBroker
+	err = brk.NewBroker(cfg.Broker)
+	if err != nil {
+		log.Fatal("main(): Unable to create in-memory broker", "err", err)
+	}
+
+	// AI service
+	var a ai.Ai
+	a.Consumer = &brk
+	a.Producer = &brk
+	err = a.NewAi(&cfg)
+	if err != nil {
+		log.Fatal("main(): Unable to create ai object", "err", err)
+	}
+	defer a.Close()
+
+	// Bot object
+	var b bot.Bot
+	b.Consumer = &brk
+	b.Producer = &brk
+	err = b.NewBot(&cfg)
+	if err != nil {
+		log.Fatal("main(): Unable to create a new bot", "err", err)
+	} else {
+		log.Info("main(): Bot successfully created and connected to telegram api server")
+	}
+	defer b.Close()
+
+	// Metrics for Prometheus and the health pages for the orchestrator
+	var monitor metrics.Server
+	if cfg.Bot.MetricsListen != "" {
+		monitor.NewServer(cfg.Bot.MetricsListen)
+		monitor.Health(cfg.Health.Timeout, append(b.Checks(), a.Checks()...)...)
+		err = monitor.Start(func(err error) {
+			log.Error("main(): Metrics server has stopped", "err", err)
+		})
+		if err != nil {
+			log.Fatal("main(): Unable to start the metrics server", "err", err)
+		}
+		log.Info("main(): Metrics and health pages are served", "listen", cfg.Bot.MetricsListen)
+	}
+
+	// Daemon for answering questions
+	aiCtx, stopAi := context.WithCancel(context.Background())
+	defer stopAi()
+	aiDone := make(chan error, 1)
+	go func() {
+		aiDone <- a.Consumer.Consume("aiRequest", a.Workers(), a.Handle, aiCtx)
+	}()
+
+	// Daemon for listen telegram server chanel
+	go b.Listener()
+
+	// Daemon for send our data to telegram server
+	senderCtx, stopSender := context.WithCancel(context.Background())
+	defer stopSender()
+	senderDone := make(chan error, 1)
+	go func() {
+		senderDone <- b.Sender(senderCtx)
+	}()
+	monitor.SetReady(true)
+
+	select {
+	case <-ctx.Done():
+		log.Info("main(): Termination signal received, shutting down")
+		// The default handling is restored, so a second signal kills the process stuck in the shutdown
+		stop()
+	case err = <-aiDone:
+		log.Fatal("main(): Cannot consume messages", "err", err)
+	case err = <-senderDone:
+		log.Fatal("main(): Unable to send messages to telegram server", "err", err)
+	}
+
+	monitor.SetReady(false)
+
+	// Everything has to be finished before the deadline
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// The services are stopped along the message path, so the running requests get their answers
+	_ = b.StopListener(shutdownCtx)
+	for _, step := range []struct {
+		name string
+		stop context.CancelFunc
+		done chan error
+	}{
+		{"AI service", stopAi, aiDone},
+		{"Sender()", stopSender, senderDone},
+	} {
+		step.stop()
+		select {
+		case <-step.done:
+			log.Info("main(): Service has been stopped", "service", step.name)
+		case <-shutdownCtx.Done():
+			log.Error("main(): Service has not stopped in time", "service", step.name)
+		}
+	}
+	_ = monitor.Shutdown(shutdownCtx)
+}
@@ -3,96 +3,331 @@ package ai
 // Ivan Orshak, 13.07.2023
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/otiai10/openaigo"
-	"os"
+	"pocket_guide/pkg/broker"
+	"pocket_guide/pkg/config"
+	"pocket_guide/pkg/i18n"
+	"pocket_guide/pkg/storage"
+	"time"
 )
 
+// historyPreload is the number of stored messages loaded into memory
+// when the chat is seen for the first time after start
+const historyPreload = 50
+
 // NewAi Ai method connects the logging system to the object,
-// initializes the API key from the environment variables,
-// connects to the artificial intelligence server using the API key,
+// creates the chat model provider chosen by AI_PROVIDER,
 // and also creates one producer and one consumer to work with the broker
-func (a *Ai) NewAi() error {
+func (a *Ai) NewAi(cfg *config.Config) error {
 	// Logging layer
 	a.log.NewLog("logs/ai/")
 
-	//Trying to get api key from env vars
-	apiKey, flag := os.LookupEnv("GPT_TOKEN")
-	if !flag {
-		a.log.LogErr.Println("NewAi(): BOT_TOKEN env variable not found.")
+	// Chat completion parameters
+	a.settings = cfg.Ai
+
+	// Chat model backend, a preset provider is used as is
+	if a.Provider == nil {
+		a.err = a.newProvider()
+		if a.err != nil {
+			a.log.Error("NewAi(): Unable to create AI provider", "err", a.err)
+			return a.err
+		} else {
+			a.log.Info("NewAi(): AI provider has been successfully created", "provider", a.settings.Provider)
+		}
+	}
+
+	// Speech recognition of the voice messages, a preset transcriber is used as is
+	if a.Transcriber == nil {
+		a.err = a.newTranscriber()
+		if a.err != nil {
+			a.log.Error("NewAi(): Unable to create transcriber", "err", a.err)
+			return a.err
+		}
+	}
+
+	// Photos and voice messages are downloaded from telegram with the token of the bot,
+	// a preset downloader is used as is. Without it every photo would be forwarded only to fail
+	if a.Files == nil {
+		if cfg.Bot.Token == "" {
+			a.err = errors.New("BOT_TOKEN is required to download the photos and the voice messages")
+			a.log.Error("NewAi(): Unable to create the file downloader", "err", a.err)
+			return a.err
+		}
+		a.Files = NewTelegramFiles(cfg.Bot.Token)
+	}
+
+	// Service texts in the languages of the users
+	a.err = a.texts.NewCatalog()
+	if a.err != nil {
+		a.log.Error("NewAi(): Unable to load the texts", "err", a.err)
+		return a.err
+	}
+
+	// Guide persona
+	a.err = a.prompt.NewPrompt(a.settings.PromptFile)
+	if a.err != nil {
+		a.log.Error("NewAi(): Unable to load system prompt", "err", a.err)
 		return a.err
 	} else {
-		a.log.LogInfo.Println("NewAi(): The token was successfully received.")
+		a.log.Info("NewAi(): System prompt has been successfully loaded", "file", a.settings.PromptFile)
 	}
 
-	// Trying to make connection to AI servers
-	a.Client = openaigo.NewClient(apiKey)
+	// Conversation memory, its size is limited by the token budget
+	a.History.NewHistory(a.settings.HistoryTokens)
+	a.Places.NewPlaces()
+
+	// Daily token quota of the users
+	a.err = a.limits.NewLimits(cfg.LimitsFile)
+	if a.err != nil {
+		a.log.Error("NewAi(): Unable to load limits", "err", a.err)
+		return a.err
+	}
+	a.Quota.NewQuota()
+	a.Answers.NewAnswers()
+
+	// Persistence layer, the history lives only in memory if the database is not configured
+	a.err = a.Storage.NewStorage(cfg.Db)
+	if errors.Is(a.err, storage.ErrNotConfigured) {
+		a.log.Info("NewAi(): Database is not configured, working without persistence")
+	} else if a.err != nil {
+		a.log.Error("NewAi(): Unable to create storage", "err", a.err)
+		return a.err
+	} else {
+		a.log.Info("NewAi(): Storage has been successfully created")
+	}
 
 	// Creating broker objects
-	a.err = a.newMsgBrk()
+	a.err = a.newMsgBrk(cfg.Broker)
 	if a.err != nil {
-		a.log.LogErr.Println("NewAi(): Unable to create broker, error:", a.err)
+		a.log.Error("NewAi(): Unable to create broker", "err", a.err)
 		return a.err
 	} else {
-		a.log.LogInfo.Println("NewAi(): Broker has been successfully created.")
+		a.log.Info("NewAi(): Broker has been successfully created")
 	}
 
 	return nil
 }
 
+// Timeout returns the time limit for one AI request
+func (a *Ai) Timeout() time.Duration {
+	return a.settings.Timeout
+}
+
+// Workers returns the number of requests handled at the same time
+func (a *Ai) Workers() int {
+	return a.settings.Workers
+}
+
 // Close shuts down the logging system and disconnects from the broker
 func (a *Ai) Close() {
 	defer a.log.Close()
-	defer a.Consumer.Close()
-	defer a.Producer.Close()
+	defer a.Storage.Close()
+	if a.Consumer != nil {
+		defer a.Consumer.Close()
+	}
+	if a.Producer != nil {
+		defer a.Producer.Close()
+	}
 }
 
 // MakeRequest fills in the fields of the structure type variable
-// required to send the API request
-func (a *Ai) MakeRequest(data string) openaigo.ChatRequest {
-	// Убрать в конфиги
+// required to send the API request: the system prompt goes first,
+// then the previous turns of the chat and the new user message
+func (a *Ai) MakeRequest(msg broker.UserMsg) openaigo.ChatRequest {
+	chatId := msg.ChatId
+
+	// The answer is expected in the language of the user, not only in the ones the catalog has,
+	// a shared location becomes the user's current position for the next questions,
+	// until then the user is assumed to be in the city the guide is set up for
+	promptData := PromptData{Language: msg.LanguageCode}
+	place, ok := placeFromMsg(msg)
+	if ok {
+		a.rememberPlace(chatId, place)
+	} else {
+		place, ok = a.lastPlace(chatId)
+	}
+	if ok {
+		promptData.Location = place.String()
+	} else {
+		promptData.City = a.settings.City
+	}
+
+	var messages []openaigo.Message
+	system, err := a.prompt.Render(promptData)
+	if err != nil {
+		a.log.Error("MakeRequest(): Unable to render system prompt", "err", err)
+	} else {
+		messages = append(messages, openaigo.Message{Role: "system", Content: system})
+	}
+
+	history := a.History.Messages(chatId)
+	if len(history) == 0 && a.Storage.Enabled() {
+		a.loadHistory(chatId)
+		history = a.History.Messages(chatId)
+	}
+	messages = append(messages, history...)
+	messages = append(messages, openaigo.Message{Role: "user", Content: a.Question(msg)})
+
 	request := openaigo.ChatRequest{
-		Model: "gpt-3.5-turbo",
-		Messages: []openaigo.Message{
-			{Role: "user", Content: data},
-		},
+		Model:       a.settings.Model,
+		Temperature: a.settings.Temperature,
+		MaxTokens:   a.settings.MaxTokens,
+		Messages:    messages,
+	}
+	// Only the vision model is able to look at the photo
+	if msg.Photo != nil {
+		request.Model = a.settings.VisionModel
 	}
 
 	return request
 }
 
-// newMsgBrk creates a consumer/producer pair
+// Question returns the text of the user question,
+// a location message without text is turned into a question about nearby sights,
+// a photo without a caption into a question about what it shows
+func (a *Ai) Question(msg broker.UserMsg) string {
+	if msg.Data != "" {
+		return msg.Data
+	}
+	if msg.Photo != nil {
+		return a.texts.Text(msg.LanguageCode, i18n.PhotoQuestion)
+	}
+
+	place, ok := placeFromMsg(msg)
+	if ok {
+		return fmt.Sprintf(nearbyQuestion, place)
+	}
+
+	return ""
+}
+
+// SaveTurn remembers the user question and the AI answer in the chat history
+func (a *Ai) SaveTurn(msg broker.UserMsg, answer string) {
+	chatId := msg.ChatId
+	question := a.Question(msg)
+
+	a.History.Append(chatId,
+		openaigo.Message{Role: "user", Content: question},
+		openaigo.Message{Role: "assistant", Content: answer},
+	)
+
+	if !a.Storage.Enabled() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := a.Storage.Messages.Add(ctx,
+		storage.Message{ChatId: chatId, UserId: msg.UserId, Role: "user", Content: question},
+		storage.Message{ChatId: chatId, Role: "assistant", Content: answer},
+	)
+	if err != nil {
+		a.log.Error("SaveTurn(): Unable to save messages", "err", err)
+	}
+}
+
+// ResetHistory forgets the conversation of the chat in memory and in the database
+func (a *Ai) ResetHistory(chatId int64) {
+	a.History.Reset(chatId)
+
+	if !a.Storage.Enabled() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := a.Storage.Messages.DeleteChat(ctx, chatId)
+	if err != nil {
+		a.log.Error("ResetHistory(): Unable to delete messages", "err", err)
+	}
+}
+
+// loadHistory fills the in-memory history of the chat with the latest stored messages
+func (a *Ai) loadHistory(chatId int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stored, err := a.Storage.Messages.Last(ctx, chatId, historyPreload)
+	if err != nil {
+		a.log.Error("loadHistory(): Unable to load messages", "err", err)
+		return
+	}
+
+	messages := make([]openaigo.Message, 0, len(stored))
+	for _, m := range stored {
+		messages = append(messages, openaigo.Message{Role: m.Role, Content: m.Content})
+	}
+	a.History.Append(chatId, messages...)
+}
+
+// newMsgBrk creates a consumer/producer pair unless they have been set before
 // and two queues required to work with the broker
-func (a *Ai) newMsgBrk() error {
-	a.err = a.Consumer.NewBroker()
-	if a.err != nil {
-		a.log.LogErr.Println("newMsgBrk(): Unable to create consumer, error:", a.err)
-		return a.err
-	} else {
-		a.log.LogInfo.Println("newMsgBrk(): Consumer has been successfully created.")
+func (a *Ai) newMsgBrk(cfg config.Broker) error {
+	// Preset brokers (e.g. broker.MemoryBroker shared with the other service) are used as is,
+	// otherwise RabbitMQ ones are created
+	if a.Consumer == nil {
+		consumer := &broker.AmqpBroker{}
+		a.err = consumer.NewBroker(cfg)
+		if a.err != nil {
+			a.log.Error("newMsgBrk(): Unable to create consumer", "err", a.err)
+			return a.err
+		} else {
+			a.log.Info("newMsgBrk(): Consumer has been successfully created")
+		}
+		a.Consumer = consumer
 	}
 
-	a.err = a.Producer.NewBroker()
-	if a.err != nil {
-		a.log.LogErr.Println("newMsgBrk(): Unable to create producer, error:", a.err)
-		return a.err
-	} else {
-		a.log.LogInfo.Println("newMsgBrk(): Producer has been successfully created.")
+	if a.Producer == nil {
+		producer := &broker.AmqpBroker{}
+		a.err = producer.NewBroker(cfg)
+		if a.err != nil {
+			a.log.Error("newMsgBrk(): Unable to create producer", "err", a.err)
+			return a.err
+		} else {
+			a.log.Info("newMsgBrk(): Producer has been successfully created")
+		}
+		a.Producer = producer
 	}
 
 	a.err = a.Consumer.MakeQueue("aiRequest")
 	if a.err != nil {
-		a.log.LogErr.Println("newMsgBrk(): Unable to create a queue 'aiRequest', error:", a.err)
+		a.log.Error("newMsgBrk(): Unable to create a queue 'aiRequest'", "err", a.err)
 		return a.err
 	} else {
-		a.log.LogInfo.Println("newMsgBrk(): A consumer queue 'aiRequest' has been successfully created.")
+		a.log.Info("newMsgBrk(): A consumer queue 'aiRequest' has been successfully created")
 	}
 
 	a.err = a.Producer.MakeQueue("Response")
 	if a.err != nil {
-		a.log.LogErr.Println("newMsgBrk(): Unable to create a queue 'Response', error:", a.err)
+		a.log.Error("newMsgBrk(): Unable to create a queue 'Response'", "err", a.err)
 		return a.err
 	} else {
-		a.log.LogInfo.Println("newMsgBrk(): A producer queue 'Response' has been successfully created.")
+		a.log.Info("newMsgBrk(): A producer queue 'Response' has been successfully created")
+	}
+
+	return nil
+}
+
+// newProvider creates the chat model backend chosen by AI_PROVIDER:
+// 'openai' (default) works over the OpenAI API or the OpenAI-compatible endpoint from AI_BASE_URL,
+// 'mock' answers from the AI_MOCK_SCRIPT file without any network calls
+func (a *Ai) newProvider() error {
+	switch a.settings.Provider {
+	case "openai":
+		a.Provider = NewOpenAiProvider(a.settings.Token, a.settings.BaseURL)
+	case "mock":
+		provider, err := NewMockProvider(a.settings.MockScript)
+		if err != nil {
+			return err
+		}
+		a.Provider = provider
+	default:
+		return errors.New("AI_PROVIDER must be 'openai' or 'mock', got: " + a.settings.Provider)
 	}
 
 	return nil
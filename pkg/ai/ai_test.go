@@ -0,0 +1,40 @@
+package ai
+
+import (
+	"pocket_guide/pkg/broker"
+	"strings"
+	"testing"
+)
+
+func TestMakeRequestLanguage(t *testing.T) {
+	a, _ := newTestAi(t, &MockProvider{})
+
+	// A location without text gives the model no other hint of the user language
+	msg := question("")
+	msg.LanguageCode = "de"
+	msg.Location = &broker.Location{Latitude: 48.137, Longitude: 11.575}
+
+	request := a.MakeRequest(msg)
+	system := request.Messages[0].Content
+	if request.Messages[0].Role != "system" || !strings.Contains(system, `code "de"`) {
+		t.Errorf("system prompt = %q, want the reply language de", system)
+	}
+}
+
+func TestMakeRequestCity(t *testing.T) {
+	a, _ := newTestAi(t, &MockProvider{})
+	a.settings.City = "London"
+
+	request := a.MakeRequest(question("Where to eat?"))
+	if system := request.Messages[0].Content; !strings.Contains(system, "currently in London") {
+		t.Errorf("system prompt = %q, want the configured city", system)
+	}
+
+	// The shared location is more precise than the city
+	msg := question("")
+	msg.Location = &broker.Location{Latitude: 48.137, Longitude: 11.575}
+	request = a.MakeRequest(msg)
+	if system := request.Messages[0].Content; strings.Contains(system, "London") || !strings.Contains(system, "48.13700") {
+		t.Errorf("system prompt = %q, want the location instead of the city", system)
+	}
+}
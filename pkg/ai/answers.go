@@ -0,0 +1,51 @@
+package ai
+
+import (
+	"pocket_guide/pkg/broker"
+	"time"
+)
+
+// answerTTL is how long the final answers are kept for the redelivered requests,
+// the broker gives up on a request long before that
+const answerTTL = 30 * time.Minute
+
+// NewAnswers initializes an empty store of the final answers
+func (s *Answers) NewAnswers() {
+	s.items = make(map[string]storedAnswer)
+}
+
+// Add remembers the final answer of the request and forgets the expired ones,
+// the answers of the requests without a correlation id are not kept
+func (s *Answers) Add(msg broker.UserMsg) {
+	if msg.CorrelationId == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, item := range s.items {
+		if now.Sub(item.at) > answerTTL {
+			delete(s.items, id)
+		}
+	}
+	s.items[msg.CorrelationId] = storedAnswer{msg: msg, at: now}
+}
+
+// Get returns the final answer of the request if it has already been generated
+func (s *Answers) Get(correlationId string) (broker.UserMsg, bool) {
+	if correlationId == "" {
+		return broker.UserMsg{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[correlationId]
+	if !ok || time.Since(item.at) > answerTTL {
+		return broker.UserMsg{}, false
+	}
+
+	return item.msg, true
+}
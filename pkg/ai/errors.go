@@ -0,0 +1,142 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"github.com/otiai10/openaigo"
+	"io"
+	"net"
+	"net/http"
+	"pocket_guide/pkg/i18n"
+	"time"
+)
+
+// ErrorKind is the class of a failed AI request
+type ErrorKind int
+
+const (
+	ErrUnknown ErrorKind = iota
+	ErrRateLimit
+	ErrServer
+	ErrTimeout
+	ErrContextLength
+	ErrInvalidKey
+	ErrQuotaExceeded
+)
+
+// AiError is a classified error of the AI request,
+// RetryAfter is the delay asked by the server, zero if it has not been sent
+type AiError struct {
+	Kind       ErrorKind
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *AiError) Error() string {
+	return e.Kind.String() + ": " + e.Err.Error()
+}
+
+func (e *AiError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the request may succeed if it is sent again
+func (e *AiError) Temporary() bool {
+	switch e.Kind {
+	case ErrRateLimit, ErrServer, ErrTimeout:
+		return true
+	}
+
+	return false
+}
+
+// TextKey returns the message shown to the user instead of the answer
+func (e *AiError) TextKey() i18n.Key {
+	switch e.Kind {
+	case ErrRateLimit:
+		return i18n.AiRateLimit
+	case ErrServer:
+		return i18n.AiServerError
+	case ErrTimeout:
+		return i18n.AiTimeout
+	case ErrContextLength:
+		return i18n.AiContextLength
+	case ErrInvalidKey, ErrQuotaExceeded:
+		return i18n.AiMisconfigured
+	}
+
+	return i18n.AiUnavailable
+}
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrRateLimit:
+		return "rate limit"
+	case ErrServer:
+		return "server error"
+	case ErrTimeout:
+		return "timeout"
+	case ErrContextLength:
+		return "context length exceeded"
+	case ErrInvalidKey:
+		return "invalid api key"
+	case ErrQuotaExceeded:
+		return "quota exceeded"
+	}
+
+	return "unknown error"
+}
+
+// classify turns the error of the client into AiError.
+// The client loses the response headers and, for bodies that are not json, the status,
+// so they are taken from the reply recorded by the transport
+func classify(err error, reply *httpReply) *AiError {
+	var aiErr *AiError
+	if errors.As(err, &aiErr) {
+		return aiErr
+	}
+
+	result := &AiError{Kind: ErrUnknown, Err: err}
+	status := 0
+	if reply != nil {
+		status = reply.status
+		result.RetryAfter = reply.retryAfter
+	}
+
+	var apiErr openaigo.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.StatusCode != 0 {
+			status = apiErr.StatusCode
+		}
+		code, _ := apiErr.Code.(string)
+		switch {
+		case code == "context_length_exceeded":
+			result.Kind = ErrContextLength
+			return result
+		case code == "invalid_api_key":
+			result.Kind = ErrInvalidKey
+			return result
+		case apiErr.Type == openaigo.ErrorInsufficientQuota || code == "insufficient_quota":
+			// The billing quota is reported with the same status as the rate limit
+			result.Kind = ErrQuotaExceeded
+			return result
+		}
+	}
+
+	var netErr net.Error
+	switch {
+	case status == http.StatusTooManyRequests:
+		result.Kind = ErrRateLimit
+	case status == http.StatusUnauthorized:
+		result.Kind = ErrInvalidKey
+	case status >= http.StatusInternalServerError:
+		result.Kind = ErrServer
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		result.Kind = ErrTimeout
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		// The server has dropped the stream
+		result.Kind = ErrServer
+	}
+
+	return result
+}
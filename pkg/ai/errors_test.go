@@ -0,0 +1,73 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/otiai10/openaigo"
+	"io"
+	"testing"
+	"time"
+)
+
+// timeoutError is a net.Error of a dial or read that has timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassify(t *testing.T) {
+	plain := errors.New("failed")
+	tests := []struct {
+		name      string
+		err       error
+		reply     *httpReply
+		want      ErrorKind
+		temporary bool
+	}{
+		{"unknown", plain, nil, ErrUnknown, false},
+		{"bad request", plain, &httpReply{status: 400}, ErrUnknown, false},
+		{"rate limit", plain, &httpReply{status: 429}, ErrRateLimit, true},
+		{"unauthorized", plain, &httpReply{status: 401}, ErrInvalidKey, false},
+		{"internal error", plain, &httpReply{status: 500}, ErrServer, true},
+		{"bad gateway", plain, &httpReply{status: 502}, ErrServer, true},
+		{"unavailable", plain, &httpReply{status: 503}, ErrServer, true},
+		{"status of the api error", openaigo.APIError{StatusCode: 503}, &httpReply{status: 200}, ErrServer, true},
+		{"context length", openaigo.APIError{StatusCode: 400, Code: "context_length_exceeded"}, nil, ErrContextLength, false},
+		{"invalid key", openaigo.APIError{StatusCode: 401, Code: "invalid_api_key"}, nil, ErrInvalidKey, false},
+		{"quota by type", openaigo.APIError{StatusCode: 429, Type: openaigo.ErrorInsufficientQuota}, nil, ErrQuotaExceeded, false},
+		{"quota by code", openaigo.APIError{StatusCode: 429, Code: "insufficient_quota"}, nil, ErrQuotaExceeded, false},
+		{"deadline", fmt.Errorf("request: %w", context.DeadlineExceeded), nil, ErrTimeout, true},
+		{"net timeout", fmt.Errorf("read: %w", timeoutError{}), nil, ErrTimeout, true},
+		{"dropped stream", io.ErrUnexpectedEOF, nil, ErrServer, true},
+		{"cancelled", context.Canceled, nil, ErrUnknown, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := classify(test.err, test.reply)
+			if got.Kind != test.want {
+				t.Errorf("kind = %s, want %s", got.Kind, test.want)
+			}
+			if got.Temporary() != test.temporary {
+				t.Errorf("temporary = %v, want %v", got.Temporary(), test.temporary)
+			}
+			if !errors.Is(got, test.err) {
+				t.Error("the error of the client is not wrapped")
+			}
+		})
+	}
+}
+
+func TestClassifyKeepsRetryAfter(t *testing.T) {
+	got := classify(errors.New("failed"), &httpReply{status: 429, retryAfter: 3 * time.Second})
+	if got.RetryAfter != 3*time.Second {
+		t.Errorf("RetryAfter = %s, want 3s", got.RetryAfter)
+	}
+
+	// An error classified before is returned as it is
+	if again := classify(fmt.Errorf("stream: %w", got), nil); again != got {
+		t.Error("the classified error has been classified again")
+	}
+}
@@ -0,0 +1,112 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// telegramAPI is the address of the telegram Bot API
+const telegramAPI = "https://api.telegram.org"
+
+// downloadTimeout limits the download of one file within the deadline of the request,
+// a stuck download leaves the time to tell the user about it
+const downloadTimeout = 30 * time.Second
+
+// maxFileSize limits the downloaded files, voice messages of a few minutes and photos are far smaller
+const maxFileSize = 10 << 20
+
+// errFileTooLarge is returned for the files over maxFileSize
+var errFileTooLarge = errors.New("file is too large")
+
+// NewTelegramFiles creates the downloader of the files sent to the bot with its token
+func NewTelegramFiles(token string) *TelegramFiles {
+	return &TelegramFiles{
+		client: &http.Client{},
+		apiURL: telegramAPI,
+		token:  token,
+	}
+}
+
+// Fetch resolves the file id into the file path with getFile and downloads the file,
+// the errors never contain the token
+func (f *TelegramFiles) Fetch(ctx context.Context, fileId string) ([]byte, error) {
+	var file struct {
+		Ok     bool `json:"ok"`
+		Result struct {
+			FilePath string `json:"file_path"`
+			FileSize int    `json:"file_size"`
+		} `json:"result"`
+	}
+	data, err := f.get(ctx, f.apiURL+"/bot"+f.token+"/getFile?file_id="+url.QueryEscape(fileId))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, err
+	}
+	if !file.Ok || file.Result.FilePath == "" {
+		return nil, errors.New("getFile returned no file path")
+	}
+	if file.Result.FileSize > maxFileSize {
+		return nil, errFileTooLarge
+	}
+
+	return f.get(ctx, f.apiURL+"/file/bot"+f.token+"/"+file.Result.FilePath)
+}
+
+// get downloads the body of the url
+func (f *TelegramFiles) get(ctx context.Context, link string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, f.redact(err)
+	}
+	response, err := f.client.Do(request)
+	if err != nil {
+		return nil, f.redact(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("unable to download file, status: " + strconv.Itoa(response.StatusCode))
+	}
+
+	// The size reported by telegram is optional, so the body is limited too
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxFileSize+1))
+	if err != nil {
+		return nil, f.redact(err)
+	}
+	if len(data) > maxFileSize {
+		return nil, errFileTooLarge
+	}
+
+	return data, nil
+}
+
+// redact removes the token from the error, the request urls contain it
+func (f *TelegramFiles) redact(err error) error {
+	if f.token == "" {
+		return err
+	}
+
+	return errors.New(strings.ReplaceAll(err.Error(), f.token, "<token>"))
+}
+
+// download gets the file the user has sent to the bot
+func (a *Ai) download(ctx context.Context, fileId string) ([]byte, error) {
+	if a.Files == nil {
+		return nil, errors.New("files are not supported without BOT_TOKEN")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, downloadTimeout)
+	defer cancel()
+
+	return a.Files.Fetch(ctx, fileId)
+}
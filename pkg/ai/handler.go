@@ -0,0 +1,172 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"pocket_guide/pkg/broker"
+	"pocket_guide/pkg/i18n"
+	"time"
+)
+
+// Handle processes one message from the bot: service instructions are applied,
+// questions are sent to the AI and the streamed answer is published in the bot's Sender()
+func (a *Ai) Handle(msg broker.UserMsg) error {
+	// Records of the request carry its addressing
+	log := a.log.With("chat_id", msg.ChatId, "user_id", msg.UserId, "correlation_id", msg.CorrelationId)
+
+	// Service instructions from the bot
+	if msg.Command == broker.CmdReset {
+		a.ResetHistory(msg.ChatId)
+		log.Info("Handle(): Conversation history has been reset")
+		return nil
+	}
+
+	// A redelivered request that has already been answered only needs the answer to be published again,
+	// a new completion would be paid twice and saved to the history twice
+	if answer, ok := a.Answers.Get(msg.CorrelationId); ok {
+		log.Info("Handle(): Request has already been answered, publishing the answer again")
+		return a.publishFinal(answer)
+	}
+
+	if len(msg.Data) == 0 && msg.Location == nil && msg.Venue == nil && msg.Voice == nil && msg.Photo == nil {
+		return nil
+	}
+	// The voice message is replaced by its text in the answers
+	voice := msg.Voice
+	msg.Voice = nil
+
+	// One deadline covers all the stages of the request, so a delivery never takes longer than AI_TIMEOUT_SEC,
+	// the bot and the shutdown wait for the requests counting on that
+	ctx, cancel := context.WithTimeout(context.Background(), a.Timeout())
+	defer cancel()
+
+	// Answers are not generated once the daily token quota of the user is spent
+	if a.overQuota(msg) {
+		log.Info("Handle(): Daily token quota is spent", "tier", msg.Tier)
+		msg.Data = a.texts.Text(msg.LanguageCode, i18n.QuotaSpent)
+		return a.finish(msg)
+	}
+
+	// A voice message becomes the question it contains, the user sees what has been recognized
+	var echo string
+	if voice != nil {
+		audio, err := a.download(ctx, voice.FileId)
+		if err != nil {
+			log.Error("Handle(): Unable to download a voice message", "err", err)
+			msg.Data = a.texts.Text(msg.LanguageCode, i18n.VoiceFailed)
+			return a.finish(msg)
+		}
+		text, err := a.TranscribeWithRetry(ctx, audio, voice.MimeType, isoLanguage(msg.LanguageCode))
+		if err != nil {
+			log.Error("Handle(): Unable to transcribe a voice message", "err", err)
+			msg.Data = a.texts.Text(msg.LanguageCode, i18n.VoiceFailed)
+			return a.finish(msg)
+		}
+		if text == "" {
+			msg.Data = a.texts.Text(msg.LanguageCode, i18n.VoiceEmpty)
+			return a.finish(msg)
+		}
+		log.Debug("Handle(): Voice message has been transcribed", "duration", voice.Duration)
+		msg.Data = text
+		echo = a.texts.Text(msg.LanguageCode, i18n.VoiceRecognized, text)
+	}
+
+	// A photo is downloaded by its telegram file id and shown to the vision model
+	var images []Image
+	if msg.Photo != nil {
+		image, err := a.image(ctx, msg.Photo)
+		if err != nil {
+			log.Error("Handle(): Unable to download a photo", "err", err)
+			msg.Data = a.texts.Text(msg.LanguageCode, i18n.PhotoFailed)
+			return a.finish(msg)
+		}
+		log.Debug("Handle(): Photo has been downloaded", "size", len(image.Data), "mime_type", image.MimeType)
+		images = append(images, image)
+	}
+
+	// Creating a request for AI
+	request := a.MakeRequest(msg)
+
+	requestsInflight.Inc()
+	defer requestsInflight.Dec()
+	start := time.Now()
+
+	// Partial answers let the bot show the text while it is being generated
+	answer, usage, err := a.ChatWithRetry(ctx, request, images, func(text string) {
+		partial := msg
+		partial.Data = echo + text
+		partial.Partial = true
+		partial.Seq++
+		msg.Seq = partial.Seq
+
+		// A lost partial answer is replaced by the next one
+		_ = a.publish(partial, ctx)
+	})
+	observeRequest(start, err)
+	var aiErr *AiError
+	if errors.As(err, &aiErr) {
+		log.Error("Handle(): AI request failed", "err", aiErr)
+		if aiErr.Kind == ErrInvalidKey || aiErr.Kind == ErrQuotaExceeded {
+			log.Error("Handle(): The OpenAI account needs attention, no request can succeed until it is fixed")
+		}
+		// The text the user has already seen stays, the error is added below it
+		msg.Data = echo + a.texts.Text(msg.LanguageCode, aiErr.TextKey())
+		if answer != "" {
+			msg.Data = echo + answer + "\n\n" + a.texts.Text(msg.LanguageCode, aiErr.TextKey())
+		}
+	} else {
+		a.SaveTurn(msg, answer)
+		a.addUsage(msg.UserId, usage.TotalTokens)
+		tokensUsed.WithLabelValues(request.Model, "prompt").Add(float64(usage.PromptTokens))
+		tokensUsed.WithLabelValues(request.Model, "completion").Add(float64(usage.CompletionTokens))
+		log.Debug("Handle(): Answer has been generated", "prompt_tokens", usage.PromptTokens,
+			"completion_tokens", usage.CompletionTokens)
+		msg.Data = echo + answer
+	}
+
+	return a.finish(msg)
+}
+
+// finish publishes the final answer to the bot. The final message always has
+// the highest sequence number. The answer is kept for the case the publishing fails
+// and the request is redelivered
+func (a *Ai) finish(msg broker.UserMsg) error {
+	msg.Partial = false
+	msg.Seq++
+	a.Answers.Add(msg)
+
+	return a.publishFinal(msg)
+}
+
+// publishFinal publishes the final answer, even if the request context has expired
+func (a *Ai) publishFinal(msg broker.UserMsg) error {
+	pubCtx, pubCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer pubCancel()
+
+	return a.publish(msg, pubCtx)
+}
+
+// publish sends the message to the Sender() through the reply queue of the request,
+// 'Response' by default
+func (a *Ai) publish(msg broker.UserMsg, ctx context.Context) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		a.log.Error("publish(): Unable to convert into json", "err", err)
+		return err
+	}
+
+	// Answering into the queue the bot has asked for
+	qname := msg.ReplyTo
+	if qname == "" {
+		qname = "Response"
+	}
+
+	err = a.Producer.Publish(data, qname, ctx)
+	if err != nil {
+		a.log.Error("publish(): Unable to publish message to Sender()", "err", err)
+		return err
+	}
+
+	return nil
+}
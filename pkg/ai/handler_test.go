@@ -0,0 +1,413 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"pocket_guide/pkg/broker"
+	"pocket_guide/pkg/config"
+	"pocket_guide/pkg/i18n"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAi creates the AI service over the provider and the in-memory broker without any network calls,
+// the messages published to the bot are passed to the returned channel
+func newTestAi(t *testing.T, provider *MockProvider) (*Ai, <-chan broker.UserMsg) {
+	t.Helper()
+
+	a := &Ai{Provider: provider, Transcriber: &StubTranscriber{}}
+	a.log.NewLog(t.TempDir() + "/")
+	t.Cleanup(a.log.Close)
+	a.settings = config.Ai{
+		Model:         "test-model",
+		VisionModel:   "test-vision-model",
+		HistoryTokens: 2000,
+		Timeout:       5 * time.Second,
+	}
+
+	err := a.texts.NewCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.prompt.NewPrompt("../../cfg/prompt.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.limits.NewLimits("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.History.NewHistory(a.settings.HistoryTokens)
+	a.Places.NewPlaces()
+	a.Quota.NewQuota()
+	a.Answers.NewAnswers()
+
+	memory := &broker.MemoryBroker{}
+	_ = memory.NewBroker(config.Broker{})
+	a.Consumer = memory
+	a.Producer = memory
+
+	answers := make(chan broker.UserMsg, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_ = memory.Consume("Response", 1, func(msg broker.UserMsg) error {
+			answers <- msg
+			return nil
+		}, ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		memory.Close()
+	})
+
+	return a, answers
+}
+
+// stubFiles serves the files by their ids, a missing one fails like an expired file id
+type stubFiles map[string][]byte
+
+func (f stubFiles) Fetch(ctx context.Context, fileId string) ([]byte, error) {
+	data, ok := f[fileId]
+	if !ok {
+		return nil, errors.New("file not found: " + fileId)
+	}
+
+	return data, ctx.Err()
+}
+
+// finalAnswer waits for the final answer, the partial ones are collected
+func finalAnswer(t *testing.T, answers <-chan broker.UserMsg) (broker.UserMsg, []broker.UserMsg) {
+	t.Helper()
+
+	var partials []broker.UserMsg
+	for {
+		select {
+		case msg := <-answers:
+			if !msg.Partial {
+				return msg, partials
+			}
+			partials = append(partials, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no final answer")
+		}
+	}
+}
+
+// question is a text message of the user
+func question(text string) broker.UserMsg {
+	return broker.UserMsg{
+		Version:       broker.EnvelopeVersion,
+		CorrelationId: "c1",
+		ChatId:        10,
+		UserId:        20,
+		LanguageCode:  "en",
+		Data:          text,
+	}
+}
+
+func TestHandleStreamsAnswer(t *testing.T) {
+	provider := &MockProvider{Script: []MockReply{{Answer: "Big Ben is a clock tower."}}}
+	a, answers := newTestAi(t, provider)
+
+	err := a.Handle(question("What is Big Ben?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	final, partials := finalAnswer(t, answers)
+	if final.Data != "Big Ben is a clock tower." {
+		t.Errorf("final answer = %q", final.Data)
+	}
+	if len(partials) == 0 {
+		t.Fatal("no partial answers")
+	}
+	for i, partial := range partials {
+		if partial.Seq != i+1 || !strings.HasPrefix(final.Data, partial.Data) {
+			t.Errorf("partial %d = %d %q", i, partial.Seq, partial.Data)
+		}
+	}
+	if final.Seq != len(partials)+1 {
+		t.Errorf("final seq = %d, want %d", final.Seq, len(partials)+1)
+	}
+	if len(a.History.Messages(10)) != 2 {
+		t.Errorf("history has %d messages, want the question and the answer", len(a.History.Messages(10)))
+	}
+}
+
+func TestHandleKeepsBrokenAnswer(t *testing.T) {
+	provider := &MockProvider{Script: []MockReply{{
+		Answer: "Big Ben is",
+		Err:    &AiError{Kind: ErrServer, Err: errors.New("stream dropped")},
+	}}}
+	a, answers := newTestAi(t, provider)
+
+	err := a.Handle(question("What is Big Ben?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	final, _ := finalAnswer(t, answers)
+	errorText := a.texts.Text("en", (&AiError{Kind: ErrServer}).TextKey())
+	if final.Data != "Big Ben is\n\n"+errorText {
+		t.Errorf("final answer = %q, want the received text and the error", final.Data)
+	}
+	// A broken answer is not worth remembering
+	if len(a.History.Messages(10)) != 0 {
+		t.Error("broken answer has been saved to the history")
+	}
+	if len(provider.Requests) != 1 {
+		t.Errorf("%d requests, a streamed answer must not be retried", len(provider.Requests))
+	}
+}
+
+// flakyPublisher fails to publish while failing is set
+type flakyPublisher struct {
+	broker.Publisher
+	failing bool
+}
+
+func (p *flakyPublisher) Publish(msg []byte, qname string, ctx context.Context) error {
+	if p.failing {
+		return errors.New("broker is not available")
+	}
+
+	return p.Publisher.Publish(msg, qname, ctx)
+}
+
+func TestHandleRedeliveredAnswer(t *testing.T) {
+	provider := &MockProvider{Script: []MockReply{{Answer: "Big Ben is a clock tower."}}}
+	a, answers := newTestAi(t, provider)
+	publisher := &flakyPublisher{Publisher: a.Producer, failing: true}
+	a.Producer = publisher
+
+	// The answer is generated, but it can't be published, so the broker redelivers the request
+	msg := question("What is Big Ben?")
+	err := a.Handle(msg)
+	if err == nil {
+		t.Fatal("Handle() has succeeded without publishing the answer")
+	}
+
+	publisher.failing = false
+	err = a.Handle(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	final, _ := finalAnswer(t, answers)
+	if final.Data != "Big Ben is a clock tower." || final.CorrelationId != msg.CorrelationId {
+		t.Errorf("final answer = %q for %q", final.Data, final.CorrelationId)
+	}
+	if len(provider.Requests) != 1 {
+		t.Errorf("%d completions, the redelivered request must not be sent to the AI again", len(provider.Requests))
+	}
+	if len(a.History.Messages(msg.ChatId)) != 2 {
+		t.Errorf("history has %d messages, want one turn", len(a.History.Messages(msg.ChatId)))
+	}
+}
+
+func TestHandleVoice(t *testing.T) {
+	tests := []struct {
+		name        string
+		transcriber *StubTranscriber
+		audio       []byte
+		want        func(a *Ai) string
+		asked       bool
+	}{
+		{
+			name:        "recognized",
+			transcriber: &StubTranscriber{Text: "What is Big Ben?"},
+			audio:       []byte("ogg"),
+			want: func(a *Ai) string {
+				return a.texts.Text("en", i18n.VoiceRecognized, "What is Big Ben?") + "Big Ben is a clock tower."
+			},
+			asked: true,
+		},
+		{
+			name:        "silence",
+			transcriber: &StubTranscriber{Text: "What is Big Ben?"},
+			want: func(a *Ai) string {
+				return a.texts.Text("en", i18n.VoiceEmpty)
+			},
+		},
+		{
+			name:        "failed",
+			transcriber: &StubTranscriber{Err: errors.New("unsupported audio")},
+			audio:       []byte("ogg"),
+			want: func(a *Ai) string {
+				return a.texts.Text("en", i18n.VoiceFailed)
+			},
+		},
+		{
+			name:        "not downloaded",
+			transcriber: &StubTranscriber{Text: "What is Big Ben?"},
+			want: func(a *Ai) string {
+				return a.texts.Text("en", i18n.VoiceFailed)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &MockProvider{Script: []MockReply{{Answer: "Big Ben is a clock tower."}}}
+			a, answers := newTestAi(t, provider)
+			a.Transcriber = test.transcriber
+			a.Files = stubFiles{"voice": test.audio}
+
+			msg := question("")
+			msg.Voice = &broker.Voice{FileId: "voice", MimeType: "audio/ogg", Duration: 2}
+			if test.name == "not downloaded" {
+				msg.Voice.FileId = "expired"
+			}
+			err := a.Handle(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			final, _ := finalAnswer(t, answers)
+			if want := test.want(a); final.Data != want {
+				t.Errorf("final answer = %q, want %q", final.Data, want)
+			}
+			if final.Voice != nil {
+				t.Error("the audio has been sent back to the bot")
+			}
+			if asked := len(provider.Requests) != 0; asked != test.asked {
+				t.Fatalf("the AI has been asked: %v, want %v", asked, test.asked)
+			}
+			if test.asked {
+				messages := provider.Requests[0].Messages
+				if last := messages[len(messages)-1].Content; last != test.transcriber.Text {
+					t.Errorf("question = %v, want the transcript", last)
+				}
+			}
+		})
+	}
+}
+
+// hintTranscriber remembers the language hint of the transcription
+type hintTranscriber struct {
+	StubTranscriber
+	language string
+}
+
+func (t *hintTranscriber) Transcribe(ctx context.Context, audio []byte, mimeType, language string) (string, error) {
+	t.language = language
+
+	return t.StubTranscriber.Transcribe(ctx, audio, mimeType, language)
+}
+
+func TestHandleVoiceLanguage(t *testing.T) {
+	transcriber := &hintTranscriber{}
+	a, answers := newTestAi(t, &MockProvider{})
+	a.Transcriber = transcriber
+	a.Files = stubFiles{"voice": []byte("ogg")}
+
+	// German is not in the catalog, it is still the language the user speaks
+	msg := question("")
+	msg.LanguageCode = "de-AT"
+	msg.Voice = &broker.Voice{FileId: "voice", MimeType: "audio/ogg"}
+	err := a.Handle(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finalAnswer(t, answers)
+	if transcriber.language != "de" {
+		t.Errorf("language hint = %q, want de", transcriber.language)
+	}
+}
+
+// slowTranscriber takes the delay whatever the context says
+type slowTranscriber struct {
+	StubTranscriber
+	delay time.Duration
+}
+
+func (t *slowTranscriber) Transcribe(ctx context.Context, audio []byte, mimeType, language string) (string, error) {
+	time.Sleep(t.delay)
+
+	return t.StubTranscriber.Transcribe(context.Background(), audio, mimeType, language)
+}
+
+func TestHandleSharesDeadline(t *testing.T) {
+	provider := &MockProvider{Script: []MockReply{{Answer: "Big Ben is a clock tower."}}}
+	a, answers := newTestAi(t, provider)
+	a.settings.Timeout = 100 * time.Millisecond
+	a.Transcriber = &slowTranscriber{StubTranscriber: StubTranscriber{Text: "What is Big Ben?"}, delay: 150 * time.Millisecond}
+	a.Files = stubFiles{"voice": []byte("ogg")}
+
+	// The transcription has used up the time of the request, the chat doesn't get a new one
+	msg := question("")
+	msg.Voice = &broker.Voice{FileId: "voice", MimeType: "audio/ogg"}
+	start := time.Now()
+	err := a.Handle(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	final, _ := finalAnswer(t, answers)
+	echo := a.texts.Text("en", i18n.VoiceRecognized, "What is Big Ben?")
+	if want := echo + a.texts.Text("en", (&AiError{Kind: ErrTimeout}).TextKey()); final.Data != want {
+		t.Errorf("final answer = %q, want %q", final.Data, want)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Handle() took %v", elapsed)
+	}
+}
+
+func TestHandlePhoto(t *testing.T) {
+	provider := &MockProvider{Script: []MockReply{{Answer: "It is Big Ben."}}}
+	a, answers := newTestAi(t, provider)
+
+	// The bot sends the reference to the photo, a jpeg starts with its signature
+	a.Files = stubFiles{"large": []byte("\xff\xd8\xff\xe0 jpeg")}
+	msg := question("What is this?")
+	msg.Photo = &broker.Photo{FileId: "large"}
+	err := a.Handle(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	final, _ := finalAnswer(t, answers)
+	if final.Data != "It is Big Ben." {
+		t.Errorf("final answer = %q", final.Data)
+	}
+	if len(provider.Requests) != 1 || provider.Requests[0].Model != "test-vision-model" {
+		t.Errorf("requests %+v, want one to the vision model", provider.Requests)
+	}
+}
+
+// slowFiles takes the delay whatever the context says
+type slowFiles struct {
+	stubFiles
+	delay time.Duration
+}
+
+func (f slowFiles) Fetch(ctx context.Context, fileId string) ([]byte, error) {
+	time.Sleep(f.delay)
+
+	return f.stubFiles.Fetch(ctx, fileId)
+}
+
+func TestHandleSlowDownload(t *testing.T) {
+	provider := &MockProvider{Script: []MockReply{{Answer: "It is Big Ben."}}}
+	a, answers := newTestAi(t, provider)
+	a.settings.Timeout = 100 * time.Millisecond
+	a.Files = slowFiles{stubFiles: stubFiles{"large": []byte("\xff\xd8\xff\xe0 jpeg")}, delay: 150 * time.Millisecond}
+
+	// The download has used up the time of the request, the user is still told about it
+	msg := question("What is this?")
+	msg.Photo = &broker.Photo{FileId: "large"}
+	err := a.Handle(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	final, _ := finalAnswer(t, answers)
+	if want := a.texts.Text("en", i18n.PhotoFailed); final.Data != want {
+		t.Errorf("final answer = %q, want %q", final.Data, want)
+	}
+	if len(provider.Requests) != 0 {
+		t.Errorf("requests %+v, want none after the deadline", provider.Requests)
+	}
+}
@@ -0,0 +1,43 @@
+package ai
+
+import (
+	"context"
+	"pocket_guide/pkg/metrics"
+)
+
+// Checks returns the probes of the readiness page: the broker connection state
+// and the availability of the chat model backend
+func (a *Ai) Checks() []metrics.Check {
+	return []metrics.Check{
+		{Name: "broker", Run: func(ctx context.Context) error {
+			err := a.Consumer.Check(ctx)
+			if err != nil {
+				return err
+			}
+			return a.Producer.Check(ctx)
+		}},
+		{Name: "ai_provider", Run: a.Provider.Check},
+	}
+}
+
+// Check lists the models, the cheapest request that proves the endpoint is reachable and the key is valid.
+// A rate limited backend is considered available, the requests are retried with backoff
+func (p *OpenAiProvider) Check(ctx context.Context) error {
+	reply := &httpReply{}
+	_, err := p.client.ListModels(context.WithValue(ctx, replyKey{}, reply))
+	if err == nil {
+		return nil
+	}
+
+	aiErr := classify(err, reply)
+	if aiErr.Kind == ErrRateLimit {
+		return nil
+	}
+
+	return aiErr
+}
+
+// Check of the mock always succeeds, there is no backend to reach
+func (p *MockProvider) Check(ctx context.Context) error {
+	return ctx.Err()
+}
@@ -0,0 +1,134 @@
+package ai
+
+import (
+	"container/list"
+	"github.com/otiai10/openaigo"
+	"time"
+	"unicode/utf8"
+)
+
+// historyTTL is how long the conversation and the last location of an idle chat are kept in memory,
+// the stored ones are loaded from the database again when the chat comes back
+const historyTTL = 24 * time.Hour
+
+// maxHistoryChats limits the number of chats kept in memory, the least recently used ones are dropped
+const maxHistoryChats = 10000
+
+// NewHistory initializes an empty conversation store,
+// maxTokens limits the estimated size of the history kept for each chat
+func (h *History) NewHistory(maxTokens int) {
+	h.chats = make(map[int64]*list.Element)
+	h.order = list.New()
+	h.maxTokens = maxTokens
+	h.maxChats = maxHistoryChats
+	h.now = time.Now
+}
+
+// Messages returns a copy of the conversation history of the chat
+func (h *History) Messages(chatId int64) []openaigo.Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	chat := h.chat(chatId, false)
+	if chat == nil {
+		return []openaigo.Message{}
+	}
+
+	messages := make([]openaigo.Message, len(chat.messages))
+	copy(messages, chat.messages)
+
+	return messages
+}
+
+// Append adds the messages to the end of the chat history
+// and drops the oldest turns until the history fits the token budget.
+// A turn is the question of the user with the answer to it, the history always starts with a question.
+// The last turn is always kept, even if it alone exceeds the budget
+func (h *History) Append(chatId int64, messages ...openaigo.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	chat := h.chat(chatId, true)
+	turns := append(chat.messages, messages...)
+
+	total := 0
+	for _, m := range turns {
+		total += countTokens(m)
+	}
+	for len(turns) > 0 {
+		n := turnLen(turns)
+		orphan := turns[0].Role != "user"
+		if !orphan && (n == len(turns) || total <= h.maxTokens) {
+			break
+		}
+		for _, m := range turns[:n] {
+			total -= countTokens(m)
+		}
+		turns = turns[n:]
+	}
+
+	chat.messages = turns
+}
+
+// Reset forgets the whole conversation of the chat
+func (h *History) Reset(chatId int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	element, ok := h.chats[chatId]
+	if ok {
+		h.order.Remove(element)
+		delete(h.chats, chatId)
+	}
+}
+
+// chat returns the conversation of the chat and marks it as used, the idle chats are dropped.
+// A missing chat is created if create is set, otherwise nil is returned
+func (h *History) chat(chatId int64, create bool) *chatHistory {
+	now := h.now()
+	for back := h.order.Back(); back != nil; back = h.order.Back() {
+		idle := back.Value.(*chatHistory)
+		if now.Sub(idle.used) <= historyTTL {
+			break
+		}
+		h.order.Remove(back)
+		delete(h.chats, idle.chatId)
+	}
+
+	element, ok := h.chats[chatId]
+	if ok {
+		h.order.MoveToFront(element)
+	} else if create {
+		element = h.order.PushFront(&chatHistory{chatId: chatId})
+		h.chats[chatId] = element
+		for h.order.Len() > h.maxChats {
+			oldest := h.order.Back()
+			h.order.Remove(oldest)
+			delete(h.chats, oldest.Value.(*chatHistory).chatId)
+		}
+	} else {
+		return nil
+	}
+
+	chat := element.Value.(*chatHistory)
+	chat.used = now
+
+	return chat
+}
+
+// turnLen returns the number of the messages in the first turn:
+// the first message with the answers that follow it up to the next question
+func turnLen(messages []openaigo.Message) int {
+	n := 1
+	for n < len(messages) && messages[n].Role != "user" {
+		n++
+	}
+
+	return n
+}
+
+// countTokens roughly estimates the number of tokens in a message:
+// about four characters per token plus the per-message overhead of the chat format
+func countTokens(m openaigo.Message) int {
+	return utf8.RuneCountInString(m.Content)/4 + 4
+}
@@ -0,0 +1,126 @@
+package ai
+
+import (
+	"github.com/otiai10/openaigo"
+	"strings"
+	"testing"
+	"time"
+)
+
+// turn returns the question and the answer, every message is 4 + len/4 tokens
+func turn(question, answer string) []openaigo.Message {
+	return []openaigo.Message{
+		{Role: "user", Content: question},
+		{Role: "assistant", Content: answer},
+	}
+}
+
+// roles returns the roles and the contents of the messages in one line
+func roles(messages []openaigo.Message) string {
+	var parts []string
+	for _, m := range messages {
+		parts = append(parts, m.Role+":"+m.Content)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func TestHistoryTrim(t *testing.T) {
+	long := strings.Repeat("a", 400)
+	tests := []struct {
+		name      string
+		maxTokens int
+		appends   [][]openaigo.Message
+		want      string
+	}{
+		{
+			name:      "fits",
+			maxTokens: 100,
+			appends:   [][]openaigo.Message{turn("q1", "a1"), turn("q2", "a2")},
+			want:      "user:q1 assistant:a1 user:q2 assistant:a2",
+		},
+		{
+			name:      "oldest turn dropped whole",
+			maxTokens: 20,
+			appends:   [][]openaigo.Message{turn("q1", "a1"), turn("q2", "a2"), turn("q3", "a3")},
+			want:      "user:q2 assistant:a2 user:q3 assistant:a3",
+		},
+		{
+			name:      "last turn kept over the budget",
+			maxTokens: 20,
+			appends:   [][]openaigo.Message{turn("q1", "a1"), turn("q2", long)},
+			want:      "user:q2 assistant:" + long,
+		},
+		{
+			name:      "answer without its question dropped",
+			maxTokens: 100,
+			appends: [][]openaigo.Message{
+				{{Role: "assistant", Content: "a0"}, {Role: "user", Content: "q1"}, {Role: "assistant", Content: "a1"}},
+			},
+			want: "user:q1 assistant:a1",
+		},
+		{
+			name:      "several answers to one question stay together",
+			maxTokens: 16,
+			appends: [][]openaigo.Message{
+				{{Role: "user", Content: "q1"}, {Role: "assistant", Content: "a1"}, {Role: "assistant", Content: "b1"}},
+				turn("q2", "a2"),
+			},
+			want: "user:q2 assistant:a2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var h History
+			h.NewHistory(test.maxTokens)
+			for _, messages := range test.appends {
+				h.Append(1, messages...)
+			}
+
+			if got := roles(h.Messages(1)); got != test.want {
+				t.Errorf("history = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHistoryEviction(t *testing.T) {
+	var h History
+	h.NewHistory(100)
+	h.maxChats = 2
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return now }
+
+	h.Append(1, turn("q1", "a1")...)
+	h.Append(2, turn("q2", "a2")...)
+	// Reading the chat is a use, so the second one is the least recently used
+	h.Messages(1)
+	h.Append(3, turn("q3", "a3")...)
+
+	if len(h.Messages(2)) != 0 {
+		t.Error("the least recently used chat has been kept over the limit")
+	}
+	if len(h.Messages(1)) != 2 || len(h.Messages(3)) != 2 {
+		t.Error("the recently used chats have been dropped")
+	}
+
+	// Only the chat used within the TTL survives
+	now = now.Add(historyTTL / 2)
+	h.Messages(3)
+	now = now.Add(historyTTL/2 + time.Second)
+	if len(h.Messages(1)) != 0 {
+		t.Error("the idle chat has been kept after the TTL")
+	}
+	if len(h.Messages(3)) != 2 {
+		t.Error("the chat used within the TTL has been dropped")
+	}
+	if len(h.chats) != 1 || h.order.Len() != 1 {
+		t.Errorf("%d chats and %d in the order, want 1", len(h.chats), h.order.Len())
+	}
+
+	h.Reset(3)
+	if len(h.Messages(3)) != 0 || len(h.chats) != 0 || h.order.Len() != 0 {
+		t.Error("the chat has not been reset")
+	}
+}
@@ -0,0 +1,167 @@
+package ai
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"pocket_guide/pkg/broker"
+	"pocket_guide/pkg/storage"
+	"time"
+)
+
+// nearbyQuestion replaces the empty text of a location message
+const nearbyQuestion = "I am here: %s. What interesting sights and places are nearby? " +
+	"Give a short list with approximate walking distances."
+
+// NewPlaces initializes an empty store of the last shared locations,
+// the idle chats are dropped after historyTTL, the stored locations are loaded again when they come back
+func (p *Places) NewPlaces() {
+	p.chats = make(map[int64]*list.Element)
+	p.order = list.New()
+	p.maxChats = maxHistoryChats
+	p.now = time.Now
+}
+
+// Set remembers the place as the last location of the chat
+func (p *Places) Set(chatId int64, place Place) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.evict(now)
+
+	element, ok := p.chats[chatId]
+	if ok {
+		p.order.MoveToFront(element)
+	} else {
+		element = p.order.PushFront(&chatPlace{chatId: chatId})
+		p.chats[chatId] = element
+		for p.order.Len() > p.maxChats {
+			oldest := p.order.Back()
+			p.order.Remove(oldest)
+			delete(p.chats, oldest.Value.(*chatPlace).chatId)
+		}
+	}
+
+	chat := element.Value.(*chatPlace)
+	chat.place = place
+	chat.used = now
+}
+
+// Get returns the last location of the chat and marks it as used
+func (p *Places) Get(chatId int64) (Place, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.evict(now)
+
+	element, ok := p.chats[chatId]
+	if !ok {
+		return Place{}, false
+	}
+	p.order.MoveToFront(element)
+	chat := element.Value.(*chatPlace)
+	chat.used = now
+
+	return chat.place, true
+}
+
+// evict drops the chats idle for longer than historyTTL. The caller holds p.mu
+func (p *Places) evict(now time.Time) {
+	for back := p.order.Back(); back != nil; back = p.order.Back() {
+		idle := back.Value.(*chatPlace)
+		if now.Sub(idle.used) <= historyTTL {
+			break
+		}
+		p.order.Remove(back)
+		delete(p.chats, idle.chatId)
+	}
+}
+
+// String formats the place for the prompt
+func (p Place) String() string {
+	point := fmt.Sprintf("latitude %.5f, longitude %.5f", p.Latitude, p.Longitude)
+	switch {
+	case p.Title != "" && p.Address != "":
+		return fmt.Sprintf("%s, %s (%s)", p.Title, p.Address, point)
+	case p.Title != "":
+		return fmt.Sprintf("%s (%s)", p.Title, point)
+	}
+
+	return point
+}
+
+// placeFromMsg extracts the shared location or venue from the message
+func placeFromMsg(msg broker.UserMsg) (Place, bool) {
+	switch {
+	case msg.Venue != nil:
+		return Place{
+			Latitude:  msg.Venue.Location.Latitude,
+			Longitude: msg.Venue.Location.Longitude,
+			Title:     msg.Venue.Title,
+			Address:   msg.Venue.Address,
+		}, true
+	case msg.Location != nil:
+		return Place{
+			Latitude:  msg.Location.Latitude,
+			Longitude: msg.Location.Longitude,
+		}, true
+	}
+
+	return Place{}, false
+}
+
+// rememberPlace saves the last location of the chat in memory and in the database
+func (a *Ai) rememberPlace(chatId int64, place Place) {
+	a.Places.Set(chatId, place)
+
+	if !a.Storage.Enabled() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := a.Storage.Locations.Save(ctx, storage.Location{
+		ChatId:    chatId,
+		Latitude:  place.Latitude,
+		Longitude: place.Longitude,
+		Title:     place.Title,
+		Address:   place.Address,
+	})
+	if err != nil {
+		a.log.Error("rememberPlace(): Unable to save location", "err", err)
+	}
+}
+
+// lastPlace returns the last location of the chat,
+// the database is asked only if the location is not in memory
+func (a *Ai) lastPlace(chatId int64) (Place, bool) {
+	place, ok := a.Places.Get(chatId)
+	if ok || !a.Storage.Enabled() {
+		return place, ok
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stored, err := a.Storage.Locations.Get(ctx, chatId)
+	if errors.Is(err, storage.ErrNotFound) {
+		return place, false
+	} else if err != nil {
+		a.log.Error("lastPlace(): Unable to load location", "err", err)
+		return place, false
+	}
+
+	place = Place{
+		Latitude:  stored.Latitude,
+		Longitude: stored.Longitude,
+		Title:     stored.Title,
+		Address:   stored.Address,
+	}
+	a.Places.Set(chatId, place)
+
+	return place, true
+}
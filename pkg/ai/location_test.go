@@ -0,0 +1,105 @@
+package ai
+
+import (
+	"fmt"
+	"pocket_guide/pkg/broker"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleLocation(t *testing.T) {
+	tests := []struct {
+		name  string
+		msg   func(msg *broker.UserMsg)
+		place string
+	}{
+		{
+			name: "location",
+			msg: func(msg *broker.UserMsg) {
+				msg.Location = &broker.Location{Latitude: 51.50073, Longitude: -0.12463}
+			},
+			place: "latitude 51.50073, longitude -0.12463",
+		},
+		{
+			name: "venue",
+			msg: func(msg *broker.UserMsg) {
+				msg.Venue = &broker.Venue{
+					Location: broker.Location{Latitude: 51.50073, Longitude: -0.12463},
+					Title:    "Big Ben",
+					Address:  "Westminster, London",
+				}
+			},
+			place: "Big Ben, Westminster, London (latitude 51.50073, longitude -0.12463)",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &MockProvider{Script: []MockReply{{Answer: "Westminster Abbey is next to you."}, {Answer: "Yes."}}}
+			a, answers := newTestAi(t, provider)
+			a.settings.City = "Paris"
+
+			// The location without text becomes the question about the nearby sights
+			msg := question("")
+			test.msg(&msg)
+			if err := a.Handle(msg); err != nil {
+				t.Fatal(err)
+			}
+			finalAnswer(t, answers)
+
+			messages := provider.Requests[0].Messages
+			if want := fmt.Sprintf(nearbyQuestion, test.place); messages[len(messages)-1].Content != want {
+				t.Errorf("question = %v, want %q", messages[len(messages)-1].Content, want)
+			}
+
+			// The next questions are answered for the shared location instead of the configured city
+			next := question("Is it open now?")
+			next.CorrelationId = "c2"
+			if err := a.Handle(next); err != nil {
+				t.Fatal(err)
+			}
+			finalAnswer(t, answers)
+
+			system := provider.Requests[1].Messages[0].Content
+			if !strings.Contains(system, test.place) || strings.Contains(system, "Paris") {
+				t.Errorf("system prompt doesn't have the shared location instead of the city:\n%s", system)
+			}
+		})
+	}
+}
+
+func TestPlacesEviction(t *testing.T) {
+	var p Places
+	p.NewPlaces()
+	p.maxChats = 2
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	p.Set(1, Place{Title: "one"})
+	p.Set(2, Place{Title: "two"})
+	// Reading the place is a use, so the second chat is the least recently used
+	p.Get(1)
+	p.Set(3, Place{Title: "three"})
+
+	if _, ok := p.Get(2); ok {
+		t.Error("the least recently used chat has been kept over the limit")
+	}
+	if place, ok := p.Get(1); !ok || place.Title != "one" {
+		t.Errorf("place of the recently used chat = %+v, %v", place, ok)
+	}
+
+	// Only the chat used within the TTL survives
+	now = now.Add(historyTTL / 2)
+	p.Get(3)
+	now = now.Add(historyTTL/2 + time.Second)
+	if _, ok := p.Get(1); ok {
+		t.Error("the idle chat has been kept after the TTL")
+	}
+	if _, ok := p.Get(3); !ok {
+		t.Error("the chat used within the TTL has been dropped")
+	}
+	if len(p.chats) != 1 || p.order.Len() != 1 {
+		t.Errorf("%d chats and %d in the order, want 1", len(p.chats), p.order.Len())
+	}
+}
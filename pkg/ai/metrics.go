@@ -0,0 +1,53 @@
+package ai
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strings"
+	"time"
+)
+
+// The AI metrics, the broker ones are counted by pkg/broker
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "guide_ai_request_duration_seconds",
+		Help:    "Duration of the AI requests including the retries, result is 'ok' or the kind of the error.",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+	}, []string{"result"})
+	requestsInflight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "guide_ai_requests_inflight",
+		Help: "AI requests being generated right now.",
+	})
+	transcribeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "guide_ai_transcription_duration_seconds",
+		Help:    "Duration of the voice message transcriptions, result is 'ok' or the kind of the error.",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60},
+	}, []string{"result"})
+	tokensUsed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "guide_ai_tokens_total",
+		Help: "Tokens spent on the answers, kind is 'prompt' or 'completion'.",
+	}, []string{"model", "kind"})
+)
+
+// observeRequest counts the finished AI request
+func observeRequest(start time.Time, err error) {
+	requestDuration.WithLabelValues(resultLabel(err)).Observe(time.Since(start).Seconds())
+}
+
+// observeTranscription counts the finished transcription attempt
+func observeTranscription(start time.Time, err error) {
+	transcribeDuration.WithLabelValues(resultLabel(err)).Observe(time.Since(start).Seconds())
+}
+
+// resultLabel is 'ok' or the kind of the error
+func resultLabel(err error) string {
+	var aiErr *AiError
+	if errors.As(err, &aiErr) {
+		return strings.ReplaceAll(aiErr.Kind.String(), " ", "_")
+	} else if err != nil {
+		return "error"
+	}
+
+	return "ok"
+}
@@ -0,0 +1,113 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/otiai10/openaigo"
+	"os"
+	"strings"
+)
+
+// mockEcho is the answer of MockProvider without a script
+const mockEcho = "Mock answer: %s"
+
+// NewMockProvider loads the script from the json file, e.g.
+// [{"answer": "Hello"}, {"error": "rate limit"}], where the errors are ErrorKind names.
+// A step with both streams the answer and then fails, like a dropped connection.
+// An empty file name means no script
+func NewMockProvider(fileName string) (*MockProvider, error) {
+	p := &MockProvider{}
+	if fileName == "" {
+		return p, nil
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var script []struct {
+		Answer string `json:"answer"`
+		Error  string `json:"error"`
+	}
+	err = json.Unmarshal(data, &script)
+	if err != nil {
+		return nil, errors.New(fileName + ": " + err.Error())
+	}
+
+	for _, step := range script {
+		reply := MockReply{Answer: step.Answer}
+		if step.Error != "" {
+			kind, ok := parseErrorKind(step.Error)
+			if !ok {
+				return nil, errors.New(fileName + ": unknown error kind '" + step.Error + "'")
+			}
+			reply.Err = &AiError{Kind: kind, Err: errors.New("scripted by the mock provider")}
+		}
+		p.Script = append(p.Script, reply)
+	}
+
+	return p, nil
+}
+
+// ChatStream records the request and streams the next scripted answer word by word
+func (p *MockProvider) ChatStream(ctx context.Context, request openaigo.ChatRequest, onDelta func(delta string)) (openaigo.Usage, error) {
+	p.mu.Lock()
+	p.Requests = append(p.Requests, request)
+	reply := MockReply{Answer: fmt.Sprintf(mockEcho, lastQuestion(request))}
+	if len(p.Script) != 0 {
+		reply = p.Script[p.next]
+		if p.next < len(p.Script)-1 {
+			p.next++
+		}
+	}
+	p.mu.Unlock()
+
+	for _, word := range strings.SplitAfter(reply.Answer, " ") {
+		if ctx.Err() != nil {
+			return openaigo.Usage{}, ctx.Err()
+		}
+		if word != "" {
+			onDelta(word)
+		}
+	}
+	// An error after an answer breaks the stream off
+	if reply.Err != nil {
+		return openaigo.Usage{}, reply.Err
+	}
+
+	return estimateUsage(request.Messages, reply.Answer), nil
+}
+
+// VisionStream records the images and answers like ChatStream, the images are not looked at
+func (p *MockProvider) VisionStream(ctx context.Context, request openaigo.ChatRequest, images []Image, onDelta func(delta string)) (openaigo.Usage, error) {
+	p.mu.Lock()
+	p.Images = append(p.Images, images...)
+	p.mu.Unlock()
+
+	return p.ChatStream(ctx, request, onDelta)
+}
+
+// lastQuestion returns the text of the last user message of the request
+func lastQuestion(request openaigo.ChatRequest) string {
+	for i := len(request.Messages) - 1; i >= 0; i-- {
+		if request.Messages[i].Role == "user" {
+			return request.Messages[i].Content
+		}
+	}
+
+	return ""
+}
+
+// parseErrorKind finds the ErrorKind by its name
+func parseErrorKind(name string) (ErrorKind, bool) {
+	for kind := ErrUnknown; kind <= ErrQuotaExceeded; kind++ {
+		if kind.String() == name {
+			return kind, true
+		}
+	}
+
+	return ErrUnknown, false
+}
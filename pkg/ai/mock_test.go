@@ -0,0 +1,110 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"github.com/otiai10/openaigo"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stream collects the pieces of the answer
+func stream(t *testing.T, p *MockProvider, question string) ([]string, openaigo.Usage, error) {
+	t.Helper()
+
+	var deltas []string
+	request := openaigo.ChatRequest{Messages: []openaigo.Message{{Role: "user", Content: question}}}
+	usage, err := p.ChatStream(context.Background(), request, func(delta string) {
+		deltas = append(deltas, delta)
+	})
+
+	return deltas, usage, err
+}
+
+func TestMockProviderEcho(t *testing.T) {
+	p := &MockProvider{}
+
+	deltas, usage, err := stream(t, p, "Where to eat?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Mock ", "answer: ", "Where ", "to ", "eat?"}
+	if len(deltas) != len(want) {
+		t.Fatalf("deltas = %q, want %q", deltas, want)
+	}
+	for i := range want {
+		if deltas[i] != want[i] {
+			t.Errorf("delta %d = %q, want %q", i, deltas[i], want[i])
+		}
+	}
+	if usage.TotalTokens == 0 || usage.TotalTokens != usage.PromptTokens+usage.CompletionTokens {
+		t.Errorf("usage = %+v", usage)
+	}
+	if len(p.Requests) != 1 {
+		t.Errorf("%d requests recorded, want 1", len(p.Requests))
+	}
+}
+
+func TestMockProviderScript(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "script.json")
+	script := `[{"answer": "One"}, {"error": "rate limit"}, {"answer": "Two three", "error": "server error"}, {"answer": "Last"}]`
+	err := os.WriteFile(fileName, []byte(script), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewMockProvider(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		deltas int
+		kind   ErrorKind
+		failed bool
+	}{
+		{deltas: 1},
+		{kind: ErrRateLimit, failed: true},
+		// The answer is streamed before the error
+		{deltas: 2, kind: ErrServer, failed: true},
+		{deltas: 1},
+		// The last step is repeated when the script ends
+		{deltas: 1},
+	}
+	for i, step := range steps {
+		deltas, _, err := stream(t, p, "q")
+		if len(deltas) != step.deltas {
+			t.Errorf("step %d: %d deltas, want %d", i, len(deltas), step.deltas)
+		}
+		var aiErr *AiError
+		if step.failed != errors.As(err, &aiErr) || (step.failed && aiErr.Kind != step.kind) {
+			t.Errorf("step %d: error = %v, want kind %v", i, err, step.kind)
+		}
+	}
+}
+
+func TestMockProviderBadScript(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "script.json")
+	err := os.WriteFile(fileName, []byte(`[{"error": "no such kind"}]`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewMockProvider(fileName)
+	if err == nil {
+		t.Error("unknown error kind has been accepted")
+	}
+}
+
+func TestMockProviderCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := &MockProvider{}
+	_, err := p.ChatStream(ctx, openaigo.ChatRequest{}, func(string) {
+		t.Error("delta after the cancellation")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+}
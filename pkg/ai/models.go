@@ -3,16 +3,224 @@ package ai
 // Ivan Orshak, 13.07.2023
 
 import (
+	"container/list"
+	"context"
 	"github.com/otiai10/openaigo"
+	"net/http"
 	"pocket_guide/pkg/broker"
+	"pocket_guide/pkg/config"
+	"pocket_guide/pkg/i18n"
+	"pocket_guide/pkg/limits"
 	"pocket_guide/pkg/logging"
+	"pocket_guide/pkg/storage"
+	"sync"
+	"text/template"
+	"time"
 )
 
 type Ai struct {
-	Client   *openaigo.Client
-	apiKey   string
-	Consumer broker.Broker
-	Producer broker.Broker
-	log      logging.Log
-	err      error
+	Provider    ChatProvider
+	Transcriber Transcriber
+	Files       Files
+	History     History
+	Places      Places
+	Quota       Quota
+	Answers     Answers
+	limits      limits.Limits
+	texts       i18n.Catalog
+	settings    config.Ai
+	prompt      Prompt
+	Consumer    broker.Consumer
+	Producer    broker.Publisher
+	Storage     storage.Storage
+	log         logging.Log
+	err         error
+}
+
+// ChatProvider is a chat model backend. Requests and answers use the OpenAI chat format,
+// the de facto standard of the chat model APIs
+type ChatProvider interface {
+	// ChatStream sends the request and passes the pieces of the answer to onDelta
+	// one after another while it is being generated. The usage is zero if the backend doesn't report it.
+	// onDelta is never called after ChatStream has returned
+	ChatStream(ctx context.Context, request openaigo.ChatRequest, onDelta func(delta string)) (openaigo.Usage, error)
+	// VisionStream is ChatStream with the images attached to the last user message of the request,
+	// the model of the request must accept images
+	VisionStream(ctx context.Context, request openaigo.ChatRequest, images []Image, onDelta func(delta string)) (openaigo.Usage, error)
+	// Check makes a cheap request to find out whether the backend is available
+	Check(ctx context.Context) error
+}
+
+// OpenAiProvider is the ChatProvider working over the OpenAI API
+// or any OpenAI-compatible endpoint, e.g. a self-hosted model
+type OpenAiProvider struct {
+	client *openaigo.Client
+}
+
+// Image is a picture attached to the question
+type Image struct {
+	Data     []byte
+	MimeType string
+}
+
+// Files downloads the files the users have sent to the bot by their telegram file ids
+type Files interface {
+	Fetch(ctx context.Context, fileId string) ([]byte, error)
+}
+
+// TelegramFiles is the Files working over the telegram Bot API with the token of the bot
+type TelegramFiles struct {
+	client *http.Client
+	apiURL string
+	token  string
+}
+
+// visionRequest is the chat request with the images in the content of the user message,
+// openaigo sends the content as plain text only
+type visionRequest struct {
+	Model         string          `json:"model"`
+	Messages      []visionMessage `json:"messages"`
+	Temperature   float32         `json:"temperature,omitempty"`
+	MaxTokens     int             `json:"max_tokens,omitempty"`
+	Stream        bool            `json:"stream"`
+	StreamOptions *streamOptions  `json:"stream_options,omitempty"`
+}
+
+// visionMessage is a chat message, Content is either a string or a list of contentPart
+type visionMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+// contentPart is a piece of the message content: a text or an image
+type contentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *imageURL `json:"image_url,omitempty"`
+}
+
+// imageURL points to the image, a data url carries the image itself
+type imageURL struct {
+	URL string `json:"url"`
+}
+
+// streamOptions asks the server to report the usage in the last piece of the stream
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// Transcriber turns speech into text, the language code is a hint, empty means auto-detection
+type Transcriber interface {
+	Transcribe(ctx context.Context, audio []byte, mimeType, language string) (string, error)
+}
+
+// WhisperTranscriber is the Transcriber working over the OpenAI audio API
+// or any Whisper-compatible endpoint, e.g. a self-hosted whisper server
+type WhisperTranscriber struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+	model   string
+}
+
+// StubTranscriber recognizes Text in any non-empty audio without any network calls,
+// it is used in tests and local development. Err is returned instead of the text if it is set
+type StubTranscriber struct {
+	Text string
+	Err  error
+}
+
+// MockProvider is a deterministic ChatProvider for tests and local development.
+// Answers are taken from Script one by one, the last one is repeated when the script ends.
+// Without a script the question is echoed back
+type MockProvider struct {
+	mu       sync.Mutex
+	Script   []MockReply
+	Requests []openaigo.ChatRequest
+	// Images are the images of the vision requests
+	Images []Image
+	next   int
+}
+
+// MockReply is one scripted answer, Err is returned after the answer has been streamed if it is set
+type MockReply struct {
+	Answer string `json:"answer"`
+	Err    error  `json:"-"`
+}
+
+// History stores the conversation of each chat
+// so the AI can answer follow-up questions. The chats are kept in the order of use,
+// the idle and the least recently used ones are dropped
+type History struct {
+	mu        sync.Mutex
+	chats     map[int64]*list.Element
+	order     *list.List
+	maxTokens int
+	maxChats  int
+	now       func() time.Time
+}
+
+// chatHistory is the conversation of one chat with the time it has been used last
+type chatHistory struct {
+	chatId   int64
+	messages []openaigo.Message
+	used     time.Time
+}
+
+// Prompt is the system message template prepended to every request
+type Prompt struct {
+	tmpl *template.Template
+}
+
+// PromptData contains the fields available in the system prompt template
+type PromptData struct {
+	Language string
+	City     string
+	Date     string
+	Location string
+}
+
+// Places stores the last location shared in each chat. Like History, the chats are kept in the order of use,
+// the idle and the least recently used ones are dropped
+type Places struct {
+	mu       sync.Mutex
+	chats    map[int64]*list.Element
+	order    *list.List
+	maxChats int
+	now      func() time.Time
+}
+
+// chatPlace is the last location of one chat with the time it has been used last
+type chatPlace struct {
+	chatId int64
+	place  Place
+	used   time.Time
+}
+
+// Place is a shared location, Title and Address are set for venues
+type Place struct {
+	Latitude  float64
+	Longitude float64
+	Title     string
+	Address   string
+}
+
+// Answers keeps the final answers by the correlation id of the request,
+// so a redelivered request is answered again without a new completion
+type Answers struct {
+	mu    sync.Mutex
+	items map[string]storedAnswer
+}
+
+// storedAnswer is a final answer with the time it has been generated
+type storedAnswer struct {
+	msg broker.UserMsg
+	at  time.Time
+}
+
+// Quota stores the number of tokens each user has spent today
+type Quota struct {
+	mu   sync.Mutex
+	day  string
+	used map[int64]int
 }
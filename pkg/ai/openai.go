@@ -0,0 +1,217 @@
+package ai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/otiai10/openaigo"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// NewOpenAiProvider creates the client of the OpenAI API, baseURL points it
+// to an OpenAI-compatible endpoint, the official API is used if it is empty
+func NewOpenAiProvider(apiKey, baseURL string) *OpenAiProvider {
+	client := openaigo.NewClient(apiKey)
+	client.BaseURL = baseURL
+	// The transport keeps the response details the client drops, they are needed to classify the errors
+	client.HTTPClient = &http.Client{Transport: replyTransport{base: http.DefaultTransport}}
+
+	return &OpenAiProvider{client: client}
+}
+
+// errBrokenStream is returned when the stream has ended without [DONE], e.g. the connection was dropped
+var errBrokenStream = fmt.Errorf("stream has ended without [DONE]: %w", io.ErrUnexpectedEOF)
+
+// ChatStream sends the request in streaming mode, the client returns as soon as the response
+// headers are received and then calls back from its own goroutine for each piece of the answer
+func (p *OpenAiProvider) ChatStream(ctx context.Context, request openaigo.ChatRequest, onDelta func(delta string)) (openaigo.Usage, error) {
+	var mu sync.Mutex
+	var usage openaigo.Usage
+	var streamErr error
+	// returned is set when ChatStream returns, later callbacks are ignored
+	var returned bool
+	done := make(chan struct{})
+
+	request.StreamCallback = func(res openaigo.ChatCompletionResponse, finished bool, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if returned {
+			return
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if err != nil {
+			streamErr = err
+			close(done)
+			return
+		}
+		if finished {
+			close(done)
+			return
+		}
+
+		// Only some OpenAI-compatible servers report the usage in the stream
+		if res.Usage.TotalTokens != 0 {
+			usage = res.Usage
+		}
+		if len(res.Choices) != 0 && res.Choices[0].Delta.Content != "" {
+			onDelta(res.Choices[0].Delta.Content)
+		}
+	}
+
+	finish := func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		returned = true
+	}
+	defer finish()
+
+	// The client stops reading without a callback when the stream breaks off before [DONE],
+	// the closing of the response body tells about it
+	watch := &streamWatch{closed: make(chan struct{})}
+	_, err := p.client.Chat(context.WithValue(ctx, streamKey{}, watch), request)
+	if err != nil {
+		return usage, err
+	}
+
+	select {
+	case <-done:
+	case <-watch.closed:
+	case <-ctx.Done():
+		return usage, ctx.Err()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The callbacks are made before the body is closed, so done is already closed for a complete stream
+	select {
+	case <-done:
+		return usage, streamErr
+	default:
+	}
+
+	return usage, watch.error()
+}
+
+// VisionStream sends the request with the images over plain HTTP, openaigo can't put them into the messages.
+// The images go as data urls, so the endpoint doesn't need access to telegram.
+// The stream is read in the calling goroutine
+func (p *OpenAiProvider) VisionStream(ctx context.Context, request openaigo.ChatRequest, images []Image, onDelta func(delta string)) (openaigo.Usage, error) {
+	var usage openaigo.Usage
+	body := visionRequest{
+		Model:         request.Model,
+		Temperature:   request.Temperature,
+		MaxTokens:     request.MaxTokens,
+		Stream:        true,
+		StreamOptions: &streamOptions{IncludeUsage: true},
+	}
+
+	// The images belong to the question, which is the last user message
+	question := -1
+	for i, m := range request.Messages {
+		if m.Role == "user" {
+			question = i
+		}
+	}
+	for i, m := range request.Messages {
+		message := visionMessage{Role: m.Role, Content: m.Content}
+		if i == question {
+			parts := []contentPart{{Type: "text", Text: m.Content}}
+			for _, image := range images {
+				url := "data:" + image.MimeType + ";base64," + base64.StdEncoding.EncodeToString(image.Data)
+				parts = append(parts, contentPart{Type: "image_url", ImageURL: &imageURL{URL: url}})
+			}
+			message.Content = parts
+		}
+		body.Messages = append(body.Messages, message)
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return usage, err
+	}
+
+	baseURL := p.client.BaseURL
+	if baseURL == "" {
+		baseURL = openaigo.DefaultOpenAIAPIURL
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(baseURL, "/")+"/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		return usage, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if p.client.APIKey != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+p.client.APIKey)
+	}
+	if p.client.Organization != "" {
+		httpRequest.Header.Set("OpenAI-Organization", p.client.Organization)
+	}
+
+	// The client's transport records the status for the error classification
+	response, err := p.client.HTTPClient.Do(httpRequest)
+	if err != nil {
+		return usage, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return usage, apiError(response)
+	}
+
+	// Server-sent events: 'data: {chunk}' lines, the last one is 'data: [DONE]'
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, openaigo.StreamPrefixDATA) {
+			continue
+		}
+		line = bytes.TrimPrefix(line, openaigo.StreamPrefixDATA)
+		if bytes.Equal(line, openaigo.StreamDataDONE) {
+			return usage, nil
+		}
+
+		var chunk struct {
+			openaigo.ChatCompletionResponse
+			Error *openaigo.APIError `json:"error"`
+		}
+		err = json.Unmarshal(line, &chunk)
+		if err != nil {
+			return usage, err
+		}
+		if chunk.Error != nil {
+			return usage, *chunk.Error
+		}
+
+		// Only some OpenAI-compatible servers report the usage in the stream
+		if chunk.Usage.TotalTokens != 0 {
+			usage = chunk.Usage
+		}
+		if len(chunk.Choices) != 0 && chunk.Choices[0].Delta.Content != "" {
+			onDelta(chunk.Choices[0].Delta.Content)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return usage, ctx.Err()
+	}
+	if scanner.Err() != nil {
+		return usage, scanner.Err()
+	}
+
+	return usage, errBrokenStream
+}
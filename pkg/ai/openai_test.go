@@ -0,0 +1,83 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"github.com/otiai10/openaigo"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamServer answers every chat request with the server-sent events
+func streamServer(events string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte(events))
+	}))
+}
+
+func TestChatStreamComplete(t *testing.T) {
+	server := streamServer("data: {\"choices\":[{\"delta\":{\"content\":\"Big \"}}]}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"content\":\"Ben\"}}]}\n\ndata: [DONE]\n\n")
+	defer server.Close()
+
+	var answer strings.Builder
+	provider := NewOpenAiProvider("key", server.URL)
+	_, err := provider.ChatStream(context.Background(), openaigo.ChatRequest{Model: "m"}, func(delta string) {
+		answer.WriteString(delta)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.String() != "Big Ben" {
+		t.Errorf("answer = %q, want %q", answer.String(), "Big Ben")
+	}
+}
+
+func TestChatStreamBroken(t *testing.T) {
+	// The stream ends without [DONE]
+	server := streamServer("data: {\"choices\":[{\"delta\":{\"content\":\"Big \"}}]}\n\n")
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var answer strings.Builder
+	provider := NewOpenAiProvider("key", server.URL)
+	start := time.Now()
+	_, err := provider.ChatStream(ctx, openaigo.ChatRequest{Model: "m"}, func(delta string) {
+		answer.WriteString(delta)
+	})
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("ChatStream() waited for the context deadline")
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("error = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if kind := classify(err, nil).Kind; kind != ErrServer {
+		t.Errorf("kind = %v, want %v", kind, ErrServer)
+	}
+	if answer.String() != "Big " {
+		t.Errorf("answer = %q, want the received part", answer.String())
+	}
+}
+
+func TestVisionStreamBroken(t *testing.T) {
+	server := streamServer("data: {\"choices\":[{\"delta\":{\"content\":\"Big \"}}]}\n\n")
+	defer server.Close()
+
+	var answer strings.Builder
+	provider := NewOpenAiProvider("key", server.URL)
+	request := openaigo.ChatRequest{Model: "m", Messages: []openaigo.Message{{Role: "user", Content: "What is it?"}}}
+	images := []Image{{Data: []byte("jpeg"), MimeType: "image/jpeg"}}
+	_, err := provider.VisionStream(context.Background(), request, images, func(delta string) {
+		answer.WriteString(delta)
+	})
+	if !errors.Is(err, io.ErrUnexpectedEOF) || answer.String() != "Big " {
+		t.Errorf("error = %v, answer = %q, want io.ErrUnexpectedEOF and the received part", err, answer.String())
+	}
+}
@@ -0,0 +1,18 @@
+package ai
+
+import (
+	"context"
+	"net/http"
+	"pocket_guide/pkg/broker"
+)
+
+// image downloads the photo for the vision request
+func (a *Ai) image(ctx context.Context, photo *broker.Photo) (Image, error) {
+	data, err := a.download(ctx, photo.FileId)
+	if err != nil {
+		return Image{}, err
+	}
+
+	// Telegram converts the photos to jpeg, the type is still checked for the other sources
+	return Image{Data: data, MimeType: http.DetectContentType(data)}, nil
+}
@@ -0,0 +1,33 @@
+package ai
+
+import (
+	"strings"
+	"text/template"
+	"time"
+)
+
+// NewPrompt loads the system prompt template from the file
+func (p *Prompt) NewPrompt(fileName string) error {
+	tmpl, err := template.ParseFiles(fileName)
+	if err != nil {
+		return err
+	}
+	p.tmpl = tmpl
+
+	return nil
+}
+
+// Render fills in the template fields, the date defaults to today
+func (p *Prompt) Render(data PromptData) (string, error) {
+	if data.Date == "" {
+		data.Date = time.Now().Format("02.01.2006")
+	}
+
+	var sb strings.Builder
+	err := p.tmpl.Execute(&sb, data)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(sb.String()), nil
+}
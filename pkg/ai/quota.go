@@ -0,0 +1,110 @@
+package ai
+
+import (
+	"context"
+	"pocket_guide/pkg/broker"
+	"time"
+)
+
+// NewQuota initializes an empty store of the tokens spent today
+func (q *Quota) NewQuota() {
+	q.used = make(map[int64]int)
+}
+
+// Get returns the tokens spent by the user today, ok is false if they are not in memory
+func (q *Quota) Get(userId int64, day string) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(day)
+	used, ok := q.used[userId]
+
+	return used, ok
+}
+
+// Add adds the tokens to the usage of the user today and returns the new total
+func (q *Quota) Add(userId int64, day string, tokens int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(day)
+	q.used[userId] += tokens
+
+	return q.used[userId]
+}
+
+// Set replaces the usage of the user today with the stored one
+func (q *Quota) Set(userId int64, day string, tokens int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(day)
+	q.used[userId] = tokens
+}
+
+// rollover forgets the usage of the previous day
+func (q *Quota) rollover(day string) {
+	if q.day != day {
+		q.day = day
+		q.used = make(map[int64]int)
+	}
+}
+
+// overQuota reports whether the user has spent the daily tokens of the tier
+func (a *Ai) overQuota(msg broker.UserMsg) bool {
+	limit := a.limits.Tier(msg.Tier).DailyTokens
+	if limit == 0 {
+		return false
+	}
+
+	return a.usedTokens(msg.UserId) >= limit
+}
+
+// usedTokens returns the tokens spent by the user today,
+// the database is asked only if the usage is not in memory
+func (a *Ai) usedTokens(userId int64) int {
+	now := time.Now().UTC()
+	day := now.Format("2006-01-02")
+
+	used, ok := a.Quota.Get(userId, day)
+	if ok || !a.Storage.Enabled() {
+		return used
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	used, err := a.Storage.Usage.Get(ctx, userId, now)
+	if err != nil {
+		a.log.Error("usedTokens(): Unable to load token usage", "err", err)
+		return 0
+	}
+	a.Quota.Set(userId, day, used)
+
+	return used
+}
+
+// addUsage counts the tokens of the answer against the daily quota of the user
+func (a *Ai) addUsage(userId int64, tokens int) {
+	now := time.Now().UTC()
+	day := now.Format("2006-01-02")
+
+	total := a.Quota.Add(userId, day, tokens)
+
+	if !a.Storage.Enabled() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The database total includes the answers of the other AI service instances
+	stored, err := a.Storage.Usage.Add(ctx, userId, now, tokens)
+	if err != nil {
+		a.log.Error("addUsage(): Unable to save token usage", "err", err)
+		return
+	}
+	if stored > total {
+		a.Quota.Set(userId, day, stored)
+	}
+}
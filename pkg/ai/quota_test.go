@@ -0,0 +1,28 @@
+package ai
+
+import "testing"
+
+func TestQuotaDailyReset(t *testing.T) {
+	var q Quota
+	q.NewQuota()
+
+	if _, ok := q.Get(1, "2026-10-17"); ok {
+		t.Error("usage of a new user is in memory")
+	}
+	q.Add(1, "2026-10-17", 100)
+	if got := q.Add(1, "2026-10-17", 50); got != 150 {
+		t.Errorf("Add() = %d, want 150", got)
+	}
+	q.Set(2, "2026-10-17", 70)
+	if got, ok := q.Get(2, "2026-10-17"); !ok || got != 70 {
+		t.Errorf("Get(2) = %d, %v, want 70", got, ok)
+	}
+
+	// The usage of the previous day is forgotten for all users
+	if got := q.Add(1, "2026-10-18", 10); got != 10 {
+		t.Errorf("Add() on the next day = %d, want 10", got)
+	}
+	if _, ok := q.Get(2, "2026-10-18"); ok {
+		t.Error("usage of the previous day is kept")
+	}
+}
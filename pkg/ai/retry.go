@@ -0,0 +1,189 @@
+package ai
+
+import (
+	"context"
+	"github.com/otiai10/openaigo"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backoff limits of the retries, the delay doubles after each attempt
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+// httpReply is what the transport remembers about the response of one request
+type httpReply struct {
+	status     int
+	retryAfter time.Duration
+}
+
+// replyKey is the context key of the *httpReply filled by the transport
+type replyKey struct{}
+
+// replyTransport records the status and the Retry-After header of the responses
+// into the *httpReply of the request context
+type replyTransport struct {
+	base http.RoundTripper
+}
+
+func (t replyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+
+	watch, ok := req.Context().Value(streamKey{}).(*streamWatch)
+	if ok {
+		res.Body = &watchedBody{ReadCloser: res.Body, watch: watch}
+	}
+
+	reply, ok := req.Context().Value(replyKey{}).(*httpReply)
+	if ok {
+		reply.status = res.StatusCode
+		reply.retryAfter = retryAfter(res.Header, time.Now())
+	}
+
+	return res, nil
+}
+
+// streamKey is the context key of the *streamWatch the transport reports the end of the response body to
+type streamKey struct{}
+
+// streamWatch learns when the response body of a stream is closed and which error has ended its reading
+type streamWatch struct {
+	closed chan struct{}
+	once   sync.Once
+	mu     sync.Mutex
+	err    error
+}
+
+// error returns the error that has ended the reading of the stream,
+// errBrokenStream if the body has ended without one
+func (w *streamWatch) error() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	return errBrokenStream
+}
+
+// watchedBody is the response body reporting its read errors and closing to the streamWatch
+type watchedBody struct {
+	io.ReadCloser
+	watch *streamWatch
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.watch.mu.Lock()
+		b.watch.err = err
+		b.watch.mu.Unlock()
+	}
+
+	return n, err
+}
+
+func (b *watchedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.watch.once.Do(func() { close(b.watch.closed) })
+
+	return err
+}
+
+// retryAfter parses the delay asked by the server: retry-after-ms sent by OpenAI
+// or the standard Retry-After in seconds or as a date
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	if ms, err := strconv.Atoi(header.Get("Retry-After-Ms")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+
+	return 0
+}
+
+// ChatWithRetry runs ChatStream and retries the temporary failures with jittered
+// exponential backoff, up to AI_MAX_RETRIES times. The delay asked by the server is respected.
+// An answer that has already been partially streamed is not retried,
+// the user would see it start over, its text is returned with the error. The returned error is always *AiError
+func (a *Ai) ChatWithRetry(ctx context.Context, request openaigo.ChatRequest, images []Image, onChunk func(text string)) (string, openaigo.Usage, error) {
+	for attempt := 0; ; attempt++ {
+		// The chunks come from the client's goroutine
+		var streamed int32
+		reply := &httpReply{}
+
+		answer, usage, err := a.ChatStream(context.WithValue(ctx, replyKey{}, reply), request, images, func(text string) {
+			atomic.StoreInt32(&streamed, 1)
+			onChunk(text)
+		})
+		if err == nil {
+			return answer, usage, nil
+		}
+
+		aiErr := classify(err, reply)
+		if !aiErr.Temporary() || atomic.LoadInt32(&streamed) != 0 || attempt >= a.settings.MaxRetries {
+			return answer, usage, aiErr
+		}
+
+		delay := backoff(attempt)
+		if aiErr.RetryAfter > delay {
+			delay = aiErr.RetryAfter
+		}
+		// Waiting longer than the request may last is useless
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return "", usage, aiErr
+		}
+
+		a.log.Error("ChatWithRetry(): AI request failed, retrying", "retry", attempt+1, "max_retries", a.settings.MaxRetries,
+			"delay", delay, "err", aiErr)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", usage, aiErr
+		}
+	}
+}
+
+// jitter is the random source of the backoff, seeded per process,
+// so the instances retrying together get different delays
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// backoff returns a random delay between a half and the whole limit of the attempt,
+// the limit doubles with every attempt up to maxRetryDelay
+func backoff(attempt int) time.Duration {
+	limit := maxRetryDelay
+	if attempt < 5 {
+		limit = minRetryDelay << attempt
+	}
+	if limit > maxRetryDelay {
+		limit = maxRetryDelay
+	}
+
+	jitter.Lock()
+	defer jitter.Unlock()
+
+	return limit/2 + time.Duration(jitter.Int63n(int64(limit/2)+1))
+}
@@ -0,0 +1,57 @@
+package ai
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"none", http.Header{}, 0},
+		{"seconds", http.Header{"Retry-After": {"20"}}, 20 * time.Second},
+		{"date", http.Header{"Retry-After": {now.Add(90 * time.Second).Format(http.TimeFormat)}}, 90 * time.Second},
+		{"date in the past", http.Header{"Retry-After": {now.Add(-time.Minute).Format(http.TimeFormat)}}, 0},
+		{"zero", http.Header{"Retry-After": {"0"}}, 0},
+		{"negative", http.Header{"Retry-After": {"-5"}}, 0},
+		{"invalid", http.Header{"Retry-After": {"soon"}}, 0},
+		{"milliseconds", http.Header{"Retry-After-Ms": {"1500"}, "Retry-After": {"20"}}, 1500 * time.Millisecond},
+		{"invalid milliseconds", http.Header{"Retry-After-Ms": {"x"}, "Retry-After": {"2"}}, 2 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := retryAfter(test.header, now); got != test.want {
+				t.Errorf("retryAfter() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		limit   time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{4, 16 * time.Second},
+		{5, maxRetryDelay},
+		{60, maxRetryDelay},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			got := backoff(test.attempt)
+			if got < test.limit/2 || got > test.limit {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", test.attempt, got, test.limit/2, test.limit)
+			}
+		}
+	}
+}
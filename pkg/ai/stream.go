@@ -0,0 +1,60 @@
+package ai
+
+import (
+	"context"
+	"errors"
+	"github.com/otiai10/openaigo"
+	"strings"
+	"time"
+)
+
+// ChatStream sends the request to the provider in streaming mode. While the answer is being generated
+// onChunk receives the text accumulated so far, at most once per AI_STREAM_INTERVAL_MS.
+// The images are attached to the question, the request goes as a vision one then.
+// The full answer and its token usage are returned when the stream ends,
+// the text received before a failure is returned along with the error
+func (a *Ai) ChatStream(ctx context.Context, request openaigo.ChatRequest, images []Image, onChunk func(text string)) (string, openaigo.Usage, error) {
+	var answer strings.Builder
+	var lastChunk time.Time
+
+	onDelta := func(delta string) {
+		answer.WriteString(delta)
+		if time.Since(lastChunk) >= a.settings.StreamInterval && answer.Len() != 0 {
+			lastChunk = time.Now()
+			onChunk(answer.String())
+		}
+	}
+	var usage openaigo.Usage
+	var err error
+	if len(images) != 0 {
+		usage, err = a.Provider.VisionStream(ctx, request, images, onDelta)
+	} else {
+		usage, err = a.Provider.ChatStream(ctx, request, onDelta)
+	}
+	if err != nil {
+		return answer.String(), usage, err
+	}
+	if answer.Len() == 0 {
+		return "", usage, errors.New("ChatStream(): empty answer")
+	}
+
+	// The usage is estimated if the provider doesn't report it, the images are not counted
+	if usage.TotalTokens == 0 {
+		usage = estimateUsage(request.Messages, answer.String())
+	}
+
+	return answer.String(), usage, nil
+}
+
+// estimateUsage counts the tokens of the request and the answer
+// the same way the history budget does it
+func estimateUsage(messages []openaigo.Message, answer string) openaigo.Usage {
+	var usage openaigo.Usage
+	for _, m := range messages {
+		usage.PromptTokens += countTokens(m)
+	}
+	usage.CompletionTokens = countTokens(openaigo.Message{Role: "assistant", Content: answer})
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+
+	return usage
+}
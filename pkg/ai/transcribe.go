@@ -0,0 +1,205 @@
+package ai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/otiai10/openaigo"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultTranscribeURL is the OpenAI API, it is used if neither AI_TRANSCRIBE_URL nor AI_BASE_URL is set
+const defaultTranscribeURL = "https://api.openai.com/v1"
+
+// stubTranscript is recognized by StubTranscriber without a configured text
+const stubTranscript = "What is interesting to see nearby?"
+
+// NewWhisperTranscriber creates the client of the audio transcription API,
+// baseURL points it to a Whisper-compatible endpoint, the OpenAI API is used if it is empty
+func NewWhisperTranscriber(apiKey, baseURL, model string) *WhisperTranscriber {
+	if baseURL == "" {
+		baseURL = defaultTranscribeURL
+	}
+
+	return &WhisperTranscriber{
+		client:  &http.Client{},
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		model:   model,
+	}
+}
+
+// Transcribe uploads the audio to the /audio/transcriptions endpoint
+func (t *WhisperTranscriber) Transcribe(ctx context.Context, audio []byte, mimeType, language string) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	// The format is detected by the file extension, telegram voice messages are ogg/opus
+	file, err := form.CreateFormFile("file", "voice"+audioExt(mimeType))
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(audio)
+	if err != nil {
+		return "", err
+	}
+	_ = form.WriteField("model", t.model)
+	_ = form.WriteField("response_format", "json")
+	if language != "" {
+		_ = form.WriteField("language", language)
+	}
+	err = form.Close()
+	if err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, t.baseURL+"/audio/transcriptions", &body)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	if t.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+t.apiKey)
+	}
+
+	response, err := t.client.Do(request)
+	if err != nil {
+		return "", classify(err, nil)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", classify(apiError(response), &httpReply{
+			status:     response.StatusCode,
+			retryAfter: retryAfter(response.Header, time.Now()),
+		})
+	}
+
+	var result struct {
+		Text string `json:"text"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(result.Text), nil
+}
+
+// Transcribe returns the configured text for any audio
+func (t *StubTranscriber) Transcribe(ctx context.Context, audio []byte, mimeType, language string) (string, error) {
+	if t.Err != nil {
+		return "", t.Err
+	}
+	if len(audio) == 0 {
+		return "", nil
+	}
+	if t.Text == "" {
+		return stubTranscript, ctx.Err()
+	}
+
+	return t.Text, ctx.Err()
+}
+
+// TranscribeWithRetry turns the audio of the voice message into text, the temporary failures are retried
+// like the chat requests. The returned error is always *AiError
+func (a *Ai) TranscribeWithRetry(ctx context.Context, audio []byte, mimeType, language string) (string, error) {
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		text, err := a.Transcriber.Transcribe(ctx, audio, mimeType, language)
+		observeTranscription(start, err)
+		if err == nil {
+			return text, nil
+		}
+
+		aiErr := classify(err, nil)
+		if !aiErr.Temporary() || attempt >= a.settings.MaxRetries {
+			return "", aiErr
+		}
+
+		delay := backoff(attempt)
+		if aiErr.RetryAfter > delay {
+			delay = aiErr.RetryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return "", aiErr
+		}
+
+		a.log.Error("TranscribeWithRetry(): Transcription failed, retrying", "retry", attempt+1,
+			"max_retries", a.settings.MaxRetries, "delay", delay, "err", aiErr)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", aiErr
+		}
+	}
+}
+
+// newTranscriber creates the speech recognition backend chosen by AI_TRANSCRIBER,
+// the stub goes with the mock provider unless another one is set
+func (a *Ai) newTranscriber() error {
+	kind := a.settings.Transcriber
+	if kind == "" {
+		kind = "whisper"
+		if a.settings.Provider == "mock" {
+			kind = "stub"
+		}
+	}
+
+	switch kind {
+	case "whisper":
+		baseURL := a.settings.TranscribeURL
+		if baseURL == "" {
+			baseURL = a.settings.BaseURL
+		}
+		a.Transcriber = NewWhisperTranscriber(a.settings.Token, baseURL, a.settings.TranscribeModel)
+	case "stub":
+		a.Transcriber = &StubTranscriber{Text: a.settings.StubTranscript}
+	default:
+		return errors.New("AI_TRANSCRIBER must be 'whisper' or 'stub', got: " + kind)
+	}
+
+	return nil
+}
+
+// apiError reads the error from the unsuccessful response of an OpenAI-compatible endpoint,
+// the status is used as the message if the body doesn't contain one
+func apiError(response *http.Response) openaigo.APIError {
+	apiErr := struct {
+		Error openaigo.APIError `json:"error"`
+	}{openaigo.APIError{Status: response.Status, StatusCode: response.StatusCode}}
+	data, _ := io.ReadAll(io.LimitReader(response.Body, 64<<10))
+	if json.Unmarshal(data, &apiErr) != nil || apiErr.Error.Message == "" {
+		apiErr.Error.Message = response.Status
+	}
+
+	return apiErr.Error
+}
+
+// isoLanguage returns the ISO-639-1 code of the IETF language tag, e.g. "pt" for "pt-br",
+// the speech recognition accepts only the primary language as the hint
+func isoLanguage(tag string) string {
+	lang, _, _ := strings.Cut(tag, "-")
+
+	return strings.ToLower(lang)
+}
+
+// audioExt returns the file extension of the audio type, ogg for the unknown ones
+func audioExt(mimeType string) string {
+	switch mimeType {
+	case "audio/mpeg", "audio/mp3":
+		return ".mp3"
+	case "audio/mp4", "audio/m4a", "audio/x-m4a":
+		return ".m4a"
+	case "audio/wav", "audio/x-wav":
+		return ".wav"
+	case "audio/webm":
+		return ".webm"
+	}
+
+	return ".ogg"
+}
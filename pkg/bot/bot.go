@@ -5,44 +5,116 @@ package bot
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	tgWrapper "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	"os"
+	"net/http"
 	"pocket_guide/pkg/broker"
+	"pocket_guide/pkg/config"
+	"pocket_guide/pkg/i18n"
+	"pocket_guide/pkg/storage"
+	"strings"
 	"time"
 )
 
-// NewBot is a method of the Bot structure receives a telegram api token from the environment variables,
+// pollTimeout is how long a getUpdates request waits for the updates, in seconds.
+// The updates channel is closed only after the running request returns, so StopListener waits for it,
+// the value is kept well below the shutdown deadline of the commands
+const pollTimeout = 10
+
+// storeTimeout limits saving the sender of a message to the database
+const storeTimeout = 5 * time.Second
+
+// publishTimeout limits publishing a question to the AI service, it is counted from the publishing itself,
+// so the time taken by the placeholder and the database doesn't leave the broker without time
+const publishTimeout = 5 * time.Second
+
+// telegramTimeout limits a telegram api request beyond the long polling,
+// so a hanging server doesn't keep the requests and the health probes forever
+const telegramTimeout = 30 * time.Second
+
+// NewBot is a method of the Bot structure takes the telegram api token from the configuration,
 // establishes a connection with the telegram server
 // and fills in the fields of a variable of the Bot structure type
-func (b *Bot) NewBot() error {
+func (b *Bot) NewBot(cfg *config.Config) error {
 	// Logging layer
 	b.log.NewLog("logs/bot/")
 
+	// Bot settings
+	b.cfg = cfg.Bot
+	b.aiTimeout = cfg.Ai.Timeout
+	b.quiet = make(chan struct{})
+
+	// System texts in the languages of the users
+	b.err = b.texts.NewCatalog()
+	if b.err != nil {
+		b.log.Error("NewBot(): Unable to load the texts", "err", b.err)
+		return b.err
+	}
+	b.langs.items = make(map[int64]string)
+
+	// Built-in commands
+	b.err = b.registerBuiltins()
+	if b.err != nil {
+		b.log.Error("NewBot(): Unable to register built-in commands", "err", b.err)
+		return b.err
+	}
+
 	// Broker layer
-	b.err = b.newMsgBrk()
+	b.err = b.newMsgBrk(cfg.Broker)
 	if b.err != nil {
-		b.log.LogErr.Println("NewBot(): Unable to create broker, error:", b.err)
+		b.log.Error("NewBot(): Unable to create broker", "err", b.err)
 		return b.err
 	} else {
-		b.log.LogInfo.Println("NewBot(): Broker has been successfully created.")
+		b.log.Info("NewBot(): Broker has been successfully created")
+	}
+
+	// Request rates of the users
+	b.err = b.limiter.limits.NewLimits(cfg.LimitsFile)
+	if b.err != nil {
+		b.log.Error("NewBot(): Unable to load limits", "err", b.err)
+		return b.err
 	}
 
-	// Trying to get telegram bot token
-	apiKey, flag := os.LookupEnv("BOT_TOKEN")
-	if !flag {
-		b.log.LogErr.Println("NewBot(): BOT_TOKEN env variable not found.")
+	// Persistence layer, the bot works without it if the database is not configured
+	b.err = b.Storage.NewStorage(cfg.Db)
+	if errors.Is(b.err, storage.ErrNotConfigured) {
+		b.log.Info("NewBot(): Database is not configured, working without persistence")
+	} else if b.err != nil {
+		b.log.Error("NewBot(): Unable to create storage", "err", b.err)
 		return b.err
 	} else {
-		b.log.LogInfo.Println("NewBot(): The token was successfully received.")
+		b.log.Info("NewBot(): Storage has been successfully created")
 	}
 
 	// Making the connection to telegram server
-	b.bot, b.err = tgWrapper.NewBotAPI(apiKey)
+	client := &http.Client{Timeout: time.Duration(pollTimeout)*time.Second + telegramTimeout}
+	b.bot, b.err = tgWrapper.NewBotAPIWithClient(b.cfg.Token, tgWrapper.APIEndpoint, client)
 	if b.err != nil {
-		b.log.LogErr.Println("NewBot(): Unable to authorize on account, error:", b.err)
+		b.log.Error("NewBot(): Unable to authorize on account", "err", b.err)
 		return b.err
 	} else {
-		b.log.LogInfo.Println("NewBot(): Authorized on account:", b.bot.Self.UserName)
+		b.log.Info("NewBot(): Authorized on account", "account", b.bot.Self.UserName)
+	}
+
+	// Telegram delivers updates either to the webhook or by long polling, never both
+	if b.cfg.Webhook() {
+		b.err = b.startWebhook()
+		if b.err != nil {
+			b.log.Error("NewBot(): Unable to start webhook", "err", b.err)
+			return b.err
+		}
+	} else {
+		_, b.err = b.request(tgWrapper.DeleteWebhookConfig{})
+		if b.err != nil {
+			b.log.Error("NewBot(): Unable to delete webhook before long polling", "err", b.err)
+			return b.err
+		}
+	}
+
+	// Publishing the command list for autocompletion, the bot still works without it
+	err := b.pushCommands()
+	if err != nil {
+		b.log.Error("NewBot(): Unable to publish command list", "err", err)
 	}
 
 	return nil
@@ -51,124 +123,209 @@ func (b *Bot) NewBot() error {
 // Close closes the logging system and shuts down the broker
 func (b *Bot) Close() {
 	defer b.log.Close()
-	defer b.Consumer.Close()
-	defer b.Producer.Close()
+	defer b.Storage.Close()
+	if b.Consumer != nil {
+		defer b.Consumer.Close()
+	}
+	if b.Producer != nil {
+		defer b.Producer.Close()
+	}
 }
 
-// newMsgBrk creates a consumer/producer pair
+// newMsgBrk creates a consumer/producer pair unless they have been set before
 // and two queues required to work with the broker
-func (b *Bot) newMsgBrk() error {
-	//Consumer initialization
-	b.err = b.Consumer.NewBroker()
-	if b.err != nil {
-		b.log.LogErr.Println("NewBroker(): Unable to create consumer, error:", b.err)
-		return b.err
-	} else {
-		b.log.LogInfo.Println("NewBroker(): Consumer has been successfully created.")
+func (b *Bot) newMsgBrk(cfg config.Broker) error {
+	//Consumer initialization, preset brokers (e.g. broker.MemoryBroker shared with the AI service)
+	// are used as is, otherwise RabbitMQ ones are created
+	if b.Consumer == nil {
+		consumer := &broker.AmqpBroker{}
+		b.err = consumer.NewBroker(cfg)
+		if b.err != nil {
+			b.log.Error("NewBroker(): Unable to create consumer", "err", b.err)
+			return b.err
+		} else {
+			b.log.Info("NewBroker(): Consumer has been successfully created")
+		}
+		b.Consumer = consumer
 	}
 
 	// Making consumer queue
 	b.err = b.Consumer.MakeQueue("Response")
 	if b.err != nil {
-		b.log.LogErr.Println("NewBroker(): Unable to create a consumer queue, error:", b.err)
+		b.log.Error("NewBroker(): Unable to create a consumer queue", "err", b.err)
 		return b.err
 	} else {
-		b.log.LogInfo.Println("NewBroker(): A consumer queue has been successfully created.")
+		b.log.Info("NewBroker(): A consumer queue has been successfully created")
 	}
 
 	// Producer initialization
-	b.err = b.Producer.NewBroker()
-	if b.err != nil {
-		b.log.LogErr.Println("NewBroker(): Unable to create producer, error:", b.err)
-		return b.err
-	} else {
-		b.log.LogInfo.Println("NewBroker(): Producer has been successfully created.")
+	if b.Producer == nil {
+		producer := &broker.AmqpBroker{}
+		b.err = producer.NewBroker(cfg)
+		if b.err != nil {
+			b.log.Error("NewBroker(): Unable to create producer", "err", b.err)
+			return b.err
+		} else {
+			b.log.Info("NewBroker(): Producer has been successfully created")
+		}
+		b.Producer = producer
 	}
 
 	// Creating producer queues to sending requests
 	b.err = b.Producer.MakeQueue("aiRequest")
 	if b.err != nil {
-		b.log.LogErr.Println("NewBroker(): Unable to create a queue 'aiRequest', error:", b.err)
+		b.log.Error("NewBroker(): Unable to create a queue 'aiRequest'", "err", b.err)
 		return b.err
 	} else {
-		b.log.LogInfo.Println("NewBroker(): A producer queue 'aiRequest' has been successfully created.")
+		b.log.Info("NewBroker(): A producer queue 'aiRequest' has been successfully created")
 	}
 
 	return nil
 }
 
-// Listener is a method of the Bot structure endlessly listens to the message channel
-// from the telegram server and sends each update to the handler
+// Listener is a method of the Bot structure listens to the message channel
+// from the telegram server until StopListener() and passes the updates to BOT_UPDATE_WORKERS workers.
+// Updates come by long polling or through the webhook, depending on BOT_MODE.
+// When BOT_QUEUE_DEPTH updates are waiting, receiving is paused until a worker is free
 func (b *Bot) Listener() {
-	u := tgWrapper.NewUpdate(0)
-	u.Timeout = 60
-
-	// Making listening channel
-	updates := b.bot.GetUpdatesChan(u)
+	// Making listening channel, in webhook mode it is filled by the HTTP server
+	var updates tgWrapper.UpdatesChannel = b.updates
+	if !b.cfg.Webhook() {
+		u := tgWrapper.NewUpdate(0)
+		u.Timeout = pollTimeout
+		b.bot.Buffer = b.cfg.QueueDepth
+		updates = b.bot.GetUpdatesChan(u)
+	}
 
-	// For each update from telegram run handler in goroutine
-	for update := range updates {
-		go func(update tgWrapper.Update) {
-			err := b.handleMsg(update)
-			if err != nil {
-				u, _ := json.Marshal(update)
-				b.log.LogErr.Println("Listener(): Unable to handle update: ", u, " error: ", err)
+	// The workers take the updates until the channel is closed
+	for i := 0; i < b.cfg.UpdateWorkers; i++ {
+		b.handlers.Add(1)
+		go func() {
+			defer b.handlers.Done()
+			for update := range updates {
+				updatesReceived.WithLabelValues(updateType(update)).Inc()
+				updatesInflight.Inc()
+				err := b.handleMsg(update)
+				updatesInflight.Dec()
+				if err != nil {
+					u, _ := json.Marshal(update)
+					b.log.Error("Listener(): Unable to handle update", "update", string(u), "err", err)
+				}
 			}
-		}(update)
+		}()
 	}
+	b.handlers.Wait()
 }
 
-// Sender is a method of the Bot structure listens to the broker's channel
-// and sends incoming messages to the telegram server
-func (b *Bot) Sender() error {
-	// Channel to connect Sender() with consumer
-	ch := make(chan broker.UserMsg)
+// StopListener stops receiving updates from the telegram server and showing the typing status,
+// then waits for the running handlers until the context expires
+func (b *Bot) StopListener(ctx context.Context) error {
+	if b.quiet != nil {
+		close(b.quiet)
+	}
 
-	// Start listening to the broker's channel
-	go func() {
-		err := b.Consumer.Consume("Response", ch)
+	if b.cfg.Webhook() {
+		err := b.stopWebhook(ctx)
 		if err != nil {
-			b.log.LogErr.Println("Sender(): Cannot consume messages, error:", err)
+			return err
 		}
+	} else {
+		b.bot.StopReceivingUpdates()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.handlers.Wait()
+		close(done)
 	}()
 
-	// If a message is received from the broker
-	for {
-		data, _ := <-ch
-		// A goroutine is created for each incoming message
-		go func(data broker.UserMsg) {
-			if len(data.Data) != 0 {
-				// Creating a variable with the desired type to send to the telegram server via API
-				msg := tgWrapper.NewMessage(data.ChatId.Id, data.Data)
-
-				// Sending a message
-				_, err := b.bot.Send(msg)
-				if err != nil {
-					b.log.LogErr.Println("Sender(): Unable to send a message to telegram, error:", err)
-				}
-			}
-		}(data)
+	select {
+	case <-done:
+		b.log.Info("StopListener(): All updates have been handled")
+		return nil
+	case <-ctx.Done():
+		b.log.Error("StopListener(): Not all updates have been handled", "err", ctx.Err())
+		return ctx.Err()
 	}
 }
 
+// Sender is a method of the Bot structure listens to the broker's channel
+// and sends incoming messages to the telegram server until the context is cancelled
+func (b *Bot) Sender(ctx context.Context) error {
+	// Users are notified if their questions are never answered
+	go b.watchPending(ctx)
+
+	// Incoming messages are handled by BOT_SENDER_WORKERS workers of the broker
+	err := b.Consumer.Consume("Response", b.cfg.SenderWorkers, func(data broker.UserMsg) error {
+		if !data.Partial {
+			b.pending.remove(data.CorrelationId)
+		}
+		if len(data.Data) != 0 {
+			b.deliver(data)
+		}
+		return nil
+	}, ctx)
+	if err != nil {
+		b.log.Error("Sender(): Cannot consume messages", "err", err)
+		return err
+	}
+
+	return nil
+}
+
 // handleMsg is a method that contains business logic
 // and allows you to separate command messages from ordinary ones.
 // Ordinary messages are sent by the broker to the microservice for working with AI,
 // command messages are sent to their own handler
 func (b *Bot) handleMsg(update tgWrapper.Update) error {
-	// Background context to broker
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	// Records of the update carry its addressing
+	log := b.log.With("update_id", update.UpdateID)
+	if update.Message != nil {
+		log = log.With("chat_id", update.Message.Chat.ID, "user_id", userId(update.Message))
+	}
 
 	// If we got a message
 	if update.Message != nil {
+		// Remembering who is talking to us, the message is handled even if it fails
+		if b.Storage.Enabled() {
+			ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+			err := b.saveSender(update.Message, ctx)
+			cancel()
+			if err != nil {
+				log.Error("handleMsg(): Unable to save user and chat", "err", err)
+			}
+		}
+
 		// If it is a command message: '/command'
 		if update.Message.IsCommand() {
+			err := b.handleCmd(update.Message)
+			if err != nil {
+				log.Error("handleMsg(): Unable to handle command", "err", err)
+				return err
+			}
+		} else if update.Message.Text != "" || update.Message.Location != nil || update.Message.Venue != nil ||
+			update.Message.Voice != nil || len(update.Message.Photo) != 0 {
+			lang := b.language(update.Message)
+
+			// Long voice messages are expensive to transcribe and rarely contain a single question
+			voice := update.Message.Voice
+			if voice != nil && b.cfg.VoiceMaxDuration > 0 && time.Duration(voice.Duration)*time.Second > b.cfg.VoiceMaxDuration {
+				return b.reply(update.Message.Chat.ID,
+					b.texts.Text(lang, i18n.VoiceTooLong, int(b.cfg.VoiceMaxDuration/time.Second)))
+			}
 
-		} else { // If we got a standard message - send to AI service
-			err := b.msg2Ai(update, ctx)
+			// Every AI request is paid, so the request rates are limited
+			tier := b.limiter.limits.UserTier(userId(update.Message))
+			scope := b.limiter.allow(b.limiter.limits.Tier(tier), userId(update.Message), update.Message.Chat.ID)
+			if scope != limitNone {
+				log.Info("handleMsg(): Request has been rejected by the rate limit", "tier", tier, "scope", int(scope))
+				return b.reply(update.Message.Chat.ID, b.texts.Text(lang, limitKey(scope)))
+			}
+
+			// If we got a standard message, a shared location, a voice or a photo - send to AI service
+			err := b.msg2Ai(update, tier, lang)
 			if err != nil {
-				b.log.LogErr.Println("handleMsg(): Unable to send message to AI service, error:", err)
+				log.Error("handleMsg(): Unable to send message to AI service", "err", err)
 				return err
 			}
 		}
@@ -177,37 +334,134 @@ func (b *Bot) handleMsg(update tgWrapper.Update) error {
 	return nil
 }
 
-func (b *Bot) msg2Ai(update tgWrapper.Update, ctx context.Context) error {
+// msg2Ai publishes the question to the AI service, lang is the language the answer is expected in
+func (b *Bot) msg2Ai(update tgWrapper.Update, tier, lang string) error {
+	envelope := newEnvelope(update.Message)
+	envelope.Tier = tier
+	envelope.LanguageCode = b.userLanguage(update.Message)
+	log := b.log.With("chat_id", envelope.ChatId, "correlation_id", envelope.CorrelationId)
+
 	// Creating a variable with the desired type to send to the telegram server via API
-	msg := tgWrapper.NewMessage(update.Message.Chat.ID, "Дайте подумать...")
-	var data []byte
+	msg := tgWrapper.NewMessage(update.Message.Chat.ID, b.texts.Text(lang, i18n.Thinking))
+	msg.ReplyToMessageID = update.Message.MessageID
 
-	data, err := json.Marshal(update.Message)
+	// Sending a notification about request processing, the answer will be edited into it
+	placeholder, err := b.send(msg)
 	if err != nil {
-		b.log.LogErr.Println("msg2Ai(): Unable to convert into json, error:", err)
-		return err
+		log.Error("msg2Ai(): Unable to send a message to telegram", "err", err)
+	} else {
+		envelope.ReplyId = placeholder.MessageID
 	}
 
-	// Sending a notification about request processing
-	_, err = b.bot.Send(msg)
+	var data []byte
+	data, err = json.Marshal(envelope)
 	if err != nil {
-		b.log.LogErr.Println("msg2Ai(): Unable to send a message to telegram, error:", err)
+		log.Error("msg2Ai(): Unable to convert into json", "err", err)
+		return err
 	}
 
-	// Trying to publish message to AI service
-	err = b.Producer.Publish(data, "aiRequest", ctx)
+	// Trying to publish message to AI service, the answer is expected in the 'Response' queue
+	b.pending.add(envelope, b.cfg.ReplyTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	err = b.Producer.PublishRequest(data, "aiRequest", "Response", envelope.CorrelationId, ctx)
 	if err != nil {
-		b.log.LogErr.Println("msg2Ai(): Unable to publish message to AI service, error:", err)
+		b.pending.remove(envelope.CorrelationId)
+		log.Error("msg2Ai(): Unable to publish message to AI service", "err", err)
 
-		// Creating a variable with the desired type to send to the telegram server via API
-		msg = tgWrapper.NewMessage(update.Message.Chat.ID, "Извините, сервис для общения с искусственным "+
-			"интеллектом временно не работает.")
-		_, err = b.bot.Send(msg)
+		// Showing the error instead of the answer
+		envelope.Data = b.texts.Text(lang, i18n.AiUnavailable)
+		envelope.Seq = 1
+		b.deliver(envelope)
+		return err
+	}
+
+	// The user sees that the bot is typing while the AI service handles the request
+	go b.keepTyping(envelope.ChatId, envelope.CorrelationId)
+
+	return nil
+}
+
+// saveSender stores the message author and the chat in the database
+func (b *Bot) saveSender(msg *tgWrapper.Message, ctx context.Context) error {
+	if msg.From != nil {
+		err := b.Storage.Users.Save(ctx, storage.User{
+			Id:           msg.From.ID,
+			UserName:     msg.From.UserName,
+			FirstName:    msg.From.FirstName,
+			LastName:     msg.From.LastName,
+			LanguageCode: msg.From.LanguageCode,
+		})
 		if err != nil {
-			b.log.LogErr.Println("msg2Ai(): Unable to send a message to telegram, error:", err)
+			return err
 		}
+	}
+
+	return b.Storage.Chats.Save(ctx, storage.Chat{
+		Id:    msg.Chat.ID,
+		Type:  msg.Chat.Type,
+		Title: msg.Chat.Title,
+	})
+}
+
+// userId returns the id of the message author, anonymous channel posts are limited as the chat
+func userId(msg *tgWrapper.Message) int64 {
+	if msg.From == nil {
+		return msg.Chat.ID
+	}
+
+	return msg.From.ID
+}
+
+// redact removes the token from the error of the telegram client,
+// the request urls contain it, so it would get into the logs and the health pages
+func (b *Bot) redact(err error) error {
+	if err == nil || b.cfg.Token == "" || !strings.Contains(err.Error(), b.cfg.Token) {
 		return err
 	}
 
-	return nil
+	return errors.New(strings.ReplaceAll(err.Error(), b.cfg.Token, "<token>"))
+}
+
+// newEnvelope fills the broker message with the text and the addressing metadata
+// of the telegram message, so the answer goes back to the same chat
+func newEnvelope(msg *tgWrapper.Message) broker.UserMsg {
+	envelope := broker.UserMsg{
+		Version:       broker.EnvelopeVersion,
+		CorrelationId: broker.NewCorrelationId(),
+		ChatId:        msg.Chat.ID,
+		ChatType:      msg.Chat.Type,
+		MessageId:     msg.MessageID,
+		Data:          msg.Text,
+	}
+
+	if msg.From != nil {
+		envelope.UserId = msg.From.ID
+		envelope.LanguageCode = msg.From.LanguageCode
+	}
+	if msg.Location != nil {
+		envelope.Location = &broker.Location{
+			Latitude:  msg.Location.Latitude,
+			Longitude: msg.Location.Longitude,
+		}
+	}
+	if msg.Venue != nil {
+		envelope.Venue = &broker.Venue{
+			Location: broker.Location{
+				Latitude:  msg.Venue.Location.Latitude,
+				Longitude: msg.Venue.Location.Longitude,
+			},
+			Title:   msg.Venue.Title,
+			Address: msg.Venue.Address,
+		}
+	}
+	// The caption of a photo is the question about it
+	if envelope.Data == "" {
+		envelope.Data = msg.Caption
+	}
+	// Voices and photos are passed as file references, the AI service downloads them
+	envelope.Voice = voice(msg)
+	envelope.Photo = photo(msg)
+
+	return envelope
 }
@@ -0,0 +1,189 @@
+package bot
+
+import (
+	"context"
+	tgWrapper "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"pocket_guide/pkg/broker"
+	"pocket_guide/pkg/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestBot returns the bot talking to a fake telegram server which accepts every request
+func newTestBot(t *testing.T) *Bot {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/getMe") {
+			w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"username":"guide_bot"}}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":5,"chat":{"id":10}}}`))
+	}))
+	t.Cleanup(api.Close)
+
+	bot, err := tgWrapper.NewBotAPIWithClient("token", api.URL+"/bot%s/%s", api.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The webhook address must be known before the server starts listening
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := listener.Addr().String()
+	listener.Close()
+
+	b := &Bot{bot: bot}
+	b.log.NewLog(t.TempDir() + "/")
+	b.cfg = config.Bot{
+		Mode:          "webhook",
+		WebhookUrl:    "https://example.org/hook",
+		WebhookListen: listen,
+		WebhookSecret: "secret",
+		QueueDepth:    1,
+	}
+
+	return b
+}
+
+func TestNewEnvelopePhoto(t *testing.T) {
+	msg := &tgWrapper.Message{
+		MessageID: 7,
+		Chat:      &tgWrapper.Chat{ID: -100, Type: "group"},
+		From:      &tgWrapper.User{ID: 42, LanguageCode: "en"},
+		Caption:   "What is this building?",
+		Photo: []tgWrapper.PhotoSize{
+			{FileID: "small", FileUniqueID: "s", Width: 90, Height: 60, FileSize: 1000},
+			{FileID: "large", FileUniqueID: "l", Width: 1280, Height: 853, FileSize: 90000},
+			{FileID: "medium", FileUniqueID: "m", Width: 320, Height: 213, FileSize: 9000},
+		},
+	}
+
+	envelope := newEnvelope(msg)
+	if envelope.Data != msg.Caption {
+		t.Errorf("Data = %q, want the caption %q", envelope.Data, msg.Caption)
+	}
+	if envelope.Photo == nil {
+		t.Fatal("Photo is not set")
+	}
+	if envelope.Photo.FileId != "large" || envelope.Photo.Width != 1280 || envelope.Photo.Size != 90000 {
+		t.Errorf("Photo = %+v, want the largest size", *envelope.Photo)
+	}
+	if envelope.ChatId != -100 || envelope.UserId != 42 || envelope.MessageId != 7 {
+		t.Errorf("addressing = %d/%d/%d, want -100/42/7", envelope.ChatId, envelope.UserId, envelope.MessageId)
+	}
+}
+
+func TestNewEnvelopeVoice(t *testing.T) {
+	msg := &tgWrapper.Message{
+		Chat:  &tgWrapper.Chat{ID: 5, Type: "private"},
+		Voice: &tgWrapper.Voice{FileID: "voice", MimeType: "audio/ogg", Duration: 3},
+	}
+
+	// Only the reference goes through the broker, the AI service downloads the audio
+	envelope := newEnvelope(msg)
+	if envelope.Voice == nil || *envelope.Voice != (broker.Voice{FileId: "voice", MimeType: "audio/ogg", Duration: 3}) {
+		t.Errorf("Voice = %+v, want the reference to the voice message", envelope.Voice)
+	}
+}
+
+func TestNewEnvelopeText(t *testing.T) {
+	msg := &tgWrapper.Message{
+		Chat: &tgWrapper.Chat{ID: 5, Type: "private"},
+		Text: "Where to eat?",
+	}
+
+	envelope := newEnvelope(msg)
+	if envelope.Data != msg.Text || envelope.Photo != nil {
+		t.Errorf("envelope = %+v, want the text without a photo", envelope)
+	}
+}
+
+func TestUserLanguage(t *testing.T) {
+	b := &Bot{}
+	if err := b.texts.NewCatalog(); err != nil {
+		t.Fatal(err)
+	}
+	b.langs.items = map[int64]string{1: "ru"}
+
+	tests := []struct {
+		name     string
+		user     int64
+		client   string
+		want     string
+		wantText string
+	}{
+		{name: "chosen with /language", user: 1, client: "de", want: "ru", wantText: "ru"},
+		{name: "telegram client", user: 2, client: "de", want: "de", wantText: "en"},
+		{name: "catalog language", user: 2, client: "ru", want: "ru", wantText: "ru"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := &tgWrapper.Message{
+				Chat: &tgWrapper.Chat{ID: test.user},
+				From: &tgWrapper.User{ID: test.user, LanguageCode: test.client},
+			}
+			if got := b.userLanguage(msg); got != test.want {
+				t.Errorf("userLanguage() = %q, want %q", got, test.want)
+			}
+			if got := b.language(msg); got != test.wantText {
+				t.Errorf("language() = %q, want %q", got, test.wantText)
+			}
+		})
+	}
+}
+
+// slowTransport delays every telegram request
+type slowTransport struct {
+	next  http.RoundTripper
+	delay time.Duration
+}
+
+func (t slowTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	time.Sleep(t.delay)
+
+	return t.next.RoundTrip(r)
+}
+
+// timedPublisher remembers how much time the publishing context had left
+type timedPublisher struct {
+	broker.MemoryBroker
+	left chan time.Duration
+}
+
+func (p *timedPublisher) PublishRequest(msg []byte, qname, replyTo, correlationId string, ctx context.Context) error {
+	deadline, _ := ctx.Deadline()
+	p.left <- time.Until(deadline)
+
+	return ctx.Err()
+}
+
+func TestMsg2AiPublishesWithOwnDeadline(t *testing.T) {
+	b := newTestBot(t)
+	if err := b.texts.NewCatalog(); err != nil {
+		t.Fatal(err)
+	}
+	b.cfg.ReplyTimeout = time.Minute
+	b.bot.Client.(*http.Client).Transport = slowTransport{next: http.DefaultTransport, delay: 300 * time.Millisecond}
+	publisher := &timedPublisher{left: make(chan time.Duration, 1)}
+	b.Producer = publisher
+
+	// The slow placeholder doesn't take the time of the publishing
+	update := tgWrapper.Update{Message: &tgWrapper.Message{
+		MessageID: 7,
+		Chat:      &tgWrapper.Chat{ID: 10, Type: "private"},
+		Text:      "What is Big Ben?",
+	}}
+	err := b.msg2Ai(update, "", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if left := <-publisher.left; left < publishTimeout-100*time.Millisecond {
+		t.Errorf("publishing had %v left, want about %v", left, publishTimeout)
+	}
+}
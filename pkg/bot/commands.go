@@ -0,0 +1,243 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	tgWrapper "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"pocket_guide/pkg/broker"
+	"pocket_guide/pkg/i18n"
+	"strings"
+	"time"
+)
+
+// RegisterCommand is a method that adds a command to the bot's command registry.
+// It is safe to call while the updates are handled. If the bot is already connected to the telegram server,
+// the updated command list is pushed to telegram right away
+func (b *Bot) RegisterCommand(cmd Command) error {
+	cmd.Name = strings.ToLower(strings.TrimPrefix(cmd.Name, "/"))
+	if cmd.Name == "" || cmd.Handler == nil {
+		b.log.Error("RegisterCommand(): Command must have a name and a handler")
+		return errors.New("RegisterCommand(): command must have a name and a handler")
+	}
+
+	b.cmdMu.Lock()
+	if b.commands == nil {
+		b.commands = make(map[string]Command)
+	}
+	if _, ok := b.commands[cmd.Name]; ok {
+		b.cmdMu.Unlock()
+		b.log.Error("RegisterCommand(): Command is already registered", "command", cmd.Name)
+		return errors.New("RegisterCommand(): command /" + cmd.Name + " is already registered")
+	}
+
+	b.commands[cmd.Name] = cmd
+	b.cmdOrder = append(b.cmdOrder, cmd.Name)
+	b.cmdMu.Unlock()
+	b.log.Info("RegisterCommand(): Command has been successfully registered", "command", cmd.Name)
+
+	if b.bot != nil {
+		return b.pushCommands()
+	}
+
+	return nil
+}
+
+// registerBuiltins adds the commands that every bot instance supports
+func (b *Bot) registerBuiltins() error {
+	builtins := []Command{
+		{
+			Name:           "start",
+			DescriptionKey: i18n.CmdStart,
+			MaxArgs:        -1,
+			Handler:        b.cmdStart,
+		},
+		{
+			Name:           "help",
+			DescriptionKey: i18n.CmdHelp,
+			Handler:        b.cmdHelp,
+		},
+		{
+			Name:           "reset",
+			DescriptionKey: i18n.CmdReset,
+			Handler:        b.cmdReset,
+		},
+		{
+			Name:           "language",
+			DescriptionKey: i18n.CmdLanguage,
+			Usage:          "[" + strings.Join(b.texts.Languages(), "|") + "]",
+			MaxArgs:        1,
+			Handler:        b.cmdLanguage,
+		},
+	}
+
+	for _, cmd := range builtins {
+		err := b.RegisterCommand(cmd)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pushCommands sends the list of registered commands to the telegram server,
+// so users see them in the autocompletion menu. The list is sent in every language
+// of the catalog, users of other languages see the default one
+func (b *Bot) pushCommands() error {
+	scope := tgWrapper.NewBotCommandScopeDefault()
+	requests := []tgWrapper.SetMyCommandsConfig{
+		tgWrapper.NewSetMyCommandsWithScope(scope, b.commandList(i18n.DefaultLanguage)...),
+	}
+	for _, lang := range b.texts.Languages() {
+		requests = append(requests, tgWrapper.NewSetMyCommandsWithScopeAndLanguage(scope, lang, b.commandList(lang)...))
+	}
+
+	for _, request := range requests {
+		_, err := b.request(request)
+		if err != nil {
+			b.log.Error("pushCommands(): Unable to set bot commands", "err", err)
+			return err
+		}
+	}
+	b.log.Info("pushCommands(): Command list has been successfully sent to telegram")
+
+	return nil
+}
+
+// registered returns the registered commands in the order of registration
+func (b *Bot) registered() []Command {
+	b.cmdMu.RLock()
+	defer b.cmdMu.RUnlock()
+
+	cmds := make([]Command, 0, len(b.cmdOrder))
+	for _, name := range b.cmdOrder {
+		cmds = append(cmds, b.commands[name])
+	}
+
+	return cmds
+}
+
+// lookup returns the registered command with the name
+func (b *Bot) lookup(name string) (Command, bool) {
+	b.cmdMu.RLock()
+	defer b.cmdMu.RUnlock()
+
+	cmd, ok := b.commands[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// commandList returns the registered commands with their descriptions in the language
+func (b *Bot) commandList(lang string) []tgWrapper.BotCommand {
+	cmds := b.registered()
+	list := make([]tgWrapper.BotCommand, 0, len(cmds))
+	for _, cmd := range cmds {
+		list = append(list, tgWrapper.BotCommand{
+			Command:     cmd.Name,
+			Description: b.describe(cmd, lang),
+		})
+	}
+
+	return list
+}
+
+// describe returns the description of the command in the language
+func (b *Bot) describe(cmd Command, lang string) string {
+	if cmd.DescriptionKey != "" {
+		return b.texts.Text(lang, cmd.DescriptionKey)
+	}
+
+	return cmd.Description
+}
+
+// handleCmd looks up the command in the registry, validates its arguments
+// and runs the command handler. Commands addressed to other bots, e.g. '/start@other_bot' in a group, are ignored
+func (b *Bot) handleCmd(msg *tgWrapper.Message) error {
+	if !b.addressed(msg) {
+		return nil
+	}
+
+	cmd, ok := b.lookup(msg.Command())
+	if !ok {
+		return b.reply(msg.Chat.ID, b.texts.Text(b.language(msg), i18n.UnknownCommand))
+	}
+
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) < cmd.MinArgs || (cmd.MaxArgs >= 0 && len(args) > cmd.MaxArgs) {
+		return b.reply(msg.Chat.ID, b.texts.Text(b.language(msg), i18n.CommandUsage, "/"+cmd.Name+" "+cmd.Usage))
+	}
+
+	err := cmd.Handler(msg, args)
+	if err != nil {
+		b.log.Error("handleCmd(): Command has failed", "command", cmd.Name, "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// addressed reports whether the command is meant for this bot: it has no '@username' suffix or the suffix is ours
+func (b *Bot) addressed(msg *tgWrapper.Message) bool {
+	_, name, ok := strings.Cut(msg.CommandWithAt(), "@")
+	if !ok {
+		return true
+	}
+
+	return b.bot != nil && strings.EqualFold(name, b.bot.Self.UserName)
+}
+
+// reply sends a plain text message to the chat
+func (b *Bot) reply(chatId int64, text string) error {
+	_, err := b.send(tgWrapper.NewMessage(chatId, text))
+	if err != nil {
+		b.log.Error("reply(): Unable to send a message to telegram", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// cmdStart greets the user and explains what the bot can do
+func (b *Bot) cmdStart(msg *tgWrapper.Message, _ []string) error {
+	return b.reply(msg.Chat.ID, b.texts.Text(b.language(msg), i18n.StartText))
+}
+
+// cmdHelp lists all registered commands with their descriptions
+func (b *Bot) cmdHelp(msg *tgWrapper.Message, _ []string) error {
+	lang := b.language(msg)
+	var sb strings.Builder
+	sb.WriteString(b.texts.Text(lang, i18n.HelpHeader) + "\n")
+	for _, cmd := range b.registered() {
+		sb.WriteString("/" + cmd.Name)
+		if cmd.Usage != "" {
+			sb.WriteString(" " + cmd.Usage)
+		}
+		sb.WriteString(" - " + b.describe(cmd, lang) + "\n")
+	}
+
+	return b.reply(msg.Chat.ID, sb.String())
+}
+
+// cmdReset asks the AI service to forget the conversation of the chat
+func (b *Bot) cmdReset(msg *tgWrapper.Message, _ []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	request := newEnvelope(msg)
+	request.Data = ""
+	request.Command = broker.CmdReset
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		b.log.Error("cmdReset(): Unable to convert into json", "err", err)
+		return err
+	}
+
+	err = b.Producer.Publish(data, "aiRequest", ctx)
+	if err != nil {
+		b.log.Error("cmdReset(): Unable to publish message to AI service", "err", err)
+		return b.reply(msg.Chat.ID, b.texts.Text(b.language(msg), i18n.ResetFailed))
+	}
+
+	return b.reply(msg.Chat.ID, b.texts.Text(b.language(msg), i18n.ResetDone))
+}
@@ -0,0 +1,172 @@
+package bot
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"pocket_guide/pkg/i18n"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	tgWrapper "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// textTransport remembers the texts of the messages sent to telegram
+type textTransport struct {
+	next  http.RoundTripper
+	mu    sync.Mutex
+	texts []string
+}
+
+func (t *textTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		form, _ := url.ParseQuery(string(body))
+		t.mu.Lock()
+		t.texts = append(t.texts, form.Get("text"))
+		t.mu.Unlock()
+	}
+
+	return t.next.RoundTrip(r)
+}
+
+// command returns the message with the command as telegram sends it
+func command(text string) *tgWrapper.Message {
+	name, _, _ := strings.Cut(text, " ")
+
+	return &tgWrapper.Message{
+		MessageID: 1,
+		Chat:      &tgWrapper.Chat{ID: 10, Type: "group"},
+		From:      &tgWrapper.User{ID: 20, LanguageCode: "en"},
+		Text:      text,
+		Entities:  []tgWrapper.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(name)}},
+	}
+}
+
+func TestRegisterCommand(t *testing.T) {
+	b := &Bot{}
+	b.log.NewLog(t.TempDir() + "/")
+	handler := func(msg *tgWrapper.Message, args []string) error { return nil }
+
+	if err := b.RegisterCommand(Command{Name: "/Where", Handler: handler}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.commands["where"]; !ok {
+		t.Errorf("commands %v, want the name without the slash in lower case", b.cmdOrder)
+	}
+	if err := b.RegisterCommand(Command{Name: "where", Handler: handler}); err == nil {
+		t.Error("the command has been registered twice")
+	}
+	if err := b.RegisterCommand(Command{Name: "/", Handler: handler}); err == nil {
+		t.Error("the command without a name has been registered")
+	}
+	if err := b.RegisterCommand(Command{Name: "nohandler"}); err == nil {
+		t.Error("the command without a handler has been registered")
+	}
+}
+
+func TestHandleCmd(t *testing.T) {
+	var called [][]string
+	tests := []struct {
+		name  string
+		text  string
+		calls int
+		reply func(b *Bot) string
+	}{
+		{name: "command", text: "/where Big Ben", calls: 1},
+		{name: "addressed to the bot", text: "/where@Guide_Bot Big Ben", calls: 1},
+		{name: "addressed to another bot", text: "/where@other_bot Big Ben"},
+		{name: "unknown command", text: "/unknown", reply: func(b *Bot) string {
+			return b.texts.Text("en", i18n.UnknownCommand)
+		}},
+		{name: "unknown command of another bot", text: "/unknown@other_bot"},
+		{name: "too few arguments", text: "/where", reply: func(b *Bot) string {
+			return b.texts.Text("en", i18n.CommandUsage, "/where <place> [city]")
+		}},
+		{name: "too many arguments", text: "/where Big Ben London", reply: func(b *Bot) string {
+			return b.texts.Text("en", i18n.CommandUsage, "/where <place> [city]")
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBot(t)
+			if err := b.texts.NewCatalog(); err != nil {
+				t.Fatal(err)
+			}
+			transport := &textTransport{next: http.DefaultTransport}
+			b.bot.Client.(*http.Client).Transport = transport
+			called = nil
+			err := b.RegisterCommand(Command{
+				Name:    "where",
+				Usage:   "<place> [city]",
+				MinArgs: 1,
+				MaxArgs: 2,
+				Handler: func(msg *tgWrapper.Message, args []string) error {
+					called = append(called, args)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := b.handleCmd(command(test.text)); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(called) != test.calls {
+				t.Errorf("handler has been called %d times, want %d", len(called), test.calls)
+			}
+			if test.calls != 0 && strings.Join(called[0], " ") != "Big Ben" {
+				t.Errorf("arguments %q, want Big Ben", called[0])
+			}
+			var want []string
+			if test.reply != nil {
+				want = []string{test.reply(b)}
+			}
+			if strings.Join(transport.texts, "\n") != strings.Join(want, "\n") {
+				t.Errorf("replies %q, want %q", transport.texts, want)
+			}
+		})
+	}
+}
+
+func TestRegisterCommandWhileHandling(t *testing.T) {
+	b := newTestBot(t)
+	if err := b.texts.NewCatalog(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.registerBuiltins(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The race detector reports the registry changed under the running handlers
+	registered := make(chan struct{})
+	go func() {
+		defer close(registered)
+		for i := 0; i < 10; i++ {
+			err := b.RegisterCommand(Command{
+				Name:    "extra" + strconv.Itoa(i),
+				Handler: func(msg *tgWrapper.Message, args []string) error { return nil },
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := b.handleCmd(command("/help")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-registered
+
+	if _, ok := b.lookup("Extra9"); !ok {
+		t.Error("command registered while handling has not been found")
+	}
+}
@@ -0,0 +1,33 @@
+package bot
+
+import (
+	"context"
+	"pocket_guide/pkg/metrics"
+)
+
+// Checks returns the probes of the readiness page: the broker connection state
+// and the telegram api answering with the bot token
+func (b *Bot) Checks() []metrics.Check {
+	return []metrics.Check{
+		{Name: "broker", Run: func(ctx context.Context) error {
+			err := b.Consumer.Check(ctx)
+			if err != nil {
+				return err
+			}
+			return b.Producer.Check(ctx)
+		}},
+		{Name: "telegram", Run: b.checkTelegram},
+	}
+}
+
+// checkTelegram calls getMe, it fails if the api is unreachable or the token has been revoked.
+// The client has no context, so the call is abandoned by the caller when the context expires
+// and ends by itself after telegramTimeout
+func (b *Bot) checkTelegram(ctx context.Context) error {
+	_, err := b.bot.GetMe()
+	if err != nil {
+		return b.redact(err)
+	}
+
+	return ctx.Err()
+}
@@ -0,0 +1,88 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	tgWrapper "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"pocket_guide/pkg/i18n"
+	"pocket_guide/pkg/storage"
+	"strings"
+	"time"
+)
+
+// language returns the language of the replies to the message author matched to the catalog
+func (b *Bot) language(msg *tgWrapper.Message) string {
+	return b.texts.Match(b.userLanguage(msg))
+}
+
+// userLanguage returns the language of the message author as it is:
+// the one chosen with /language or the one of the telegram client.
+// The AI understands more languages than the catalog has, so it is sent to the AI service unmatched
+func (b *Bot) userLanguage(msg *tgWrapper.Message) string {
+	lang := b.preference(userId(msg))
+	if lang == "" && msg.From != nil {
+		lang = msg.From.LanguageCode
+	}
+
+	return lang
+}
+
+// preference returns the language chosen by the user, empty if there is none.
+// It is loaded from the database on the first use, failed loads are repeated next time
+func (b *Bot) preference(userId int64) string {
+	b.langs.mu.Lock()
+	lang, ok := b.langs.items[userId]
+	b.langs.mu.Unlock()
+	if ok || !b.Storage.Enabled() {
+		return lang
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := b.Storage.Users.Get(ctx, userId)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		b.log.Error("preference(): Unable to load the user language", "err", err)
+		return ""
+	}
+
+	b.langs.mu.Lock()
+	b.langs.items[userId] = user.Language
+	b.langs.mu.Unlock()
+
+	return user.Language
+}
+
+// setPreference remembers the language chosen by the user, it is kept in memory
+// even if the database is not available
+func (b *Bot) setPreference(userId int64, lang string) error {
+	b.langs.mu.Lock()
+	b.langs.items[userId] = lang
+	b.langs.mu.Unlock()
+
+	if !b.Storage.Enabled() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return b.Storage.Users.SetLanguage(ctx, userId, lang)
+}
+
+// cmdLanguage sets the language of the replies, without arguments it shows the current one
+func (b *Bot) cmdLanguage(msg *tgWrapper.Message, args []string) error {
+	lang := b.language(msg)
+	if len(args) == 0 || !b.texts.Supported(strings.ToLower(args[0])) {
+		return b.reply(msg.Chat.ID, b.texts.Text(lang, i18n.LanguageUsage,
+			b.texts.Text(lang, i18n.LanguageName), strings.Join(b.texts.Languages(), ", ")))
+	}
+
+	lang = strings.ToLower(args[0])
+	err := b.setPreference(userId(msg), lang)
+	if err != nil {
+		b.log.Error("cmdLanguage(): Unable to save the user language", "err", err)
+	}
+
+	return b.reply(msg.Chat.ID, b.texts.Text(lang, i18n.LanguageSet))
+}
@@ -0,0 +1,117 @@
+package bot
+
+import (
+	"pocket_guide/pkg/i18n"
+	"pocket_guide/pkg/limits"
+	"time"
+)
+
+// limitScope tells which limit has rejected the request
+type limitScope int
+
+const (
+	limitNone limitScope = iota
+	limitUser
+	limitChat
+	limitGlobal
+)
+
+// pruneEvery is the number of requests between removals of the idle buckets
+const pruneEvery = 1000
+
+// allow takes a token from the user, chat and global buckets,
+// nothing is taken unless all three have one
+func (l *limiter) allow(tier limits.Tier, userId, chatId int64) limitScope {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock()
+	if l.users == nil {
+		l.users = make(map[int64]*bucket)
+		l.chats = make(map[int64]*bucket)
+	}
+	l.calls++
+	if l.calls%pruneEvery == 0 {
+		l.prune(now)
+	}
+
+	user := l.bucket(l.users, userId, tier.UserBurst, now)
+	chat := l.bucket(l.chats, chatId, tier.ChatBurst, now)
+	user.refill(tier.UserRate, tier.UserBurst, now)
+	chat.refill(tier.ChatRate, tier.ChatBurst, now)
+	l.global.refill(l.limits.GlobalRate, l.limits.GlobalBurst, now)
+
+	switch {
+	case tier.UserRate > 0 && user.tokens < 1:
+		return limitUser
+	case tier.ChatRate > 0 && chat.tokens < 1:
+		return limitChat
+	case l.limits.GlobalRate > 0 && l.global.tokens < 1:
+		return limitGlobal
+	}
+
+	// Buckets without a rate are not limited, so they are not drained
+	if tier.UserRate > 0 {
+		user.tokens--
+	}
+	if tier.ChatRate > 0 {
+		chat.tokens--
+	}
+	if l.limits.GlobalRate > 0 {
+		l.global.tokens--
+	}
+
+	return limitNone
+}
+
+// clock returns the current time
+func (l *limiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+
+	return time.Now()
+}
+
+// bucket returns the bucket of the key, a new one starts full
+func (l *limiter) bucket(items map[int64]*bucket, key int64, burst int, now time.Time) *bucket {
+	b, ok := items[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		items[key] = b
+	}
+
+	return b
+}
+
+// prune removes the buckets that have been idle for an hour, they are refilled by then in any sane tier
+func (l *limiter) prune(now time.Time) {
+	for _, items := range []map[int64]*bucket{l.users, l.chats} {
+		for key, b := range items {
+			if now.Sub(b.last) > time.Hour {
+				delete(items, key)
+			}
+		}
+	}
+}
+
+// refill adds the tokens earned since the last request, rate is per minute
+func (b *bucket) refill(rate float64, burst int, now time.Time) {
+	b.tokens += now.Sub(b.last).Minutes() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+}
+
+// limitKey is the text shown to the user when the request is rejected
+func limitKey(scope limitScope) i18n.Key {
+	switch scope {
+	case limitChat:
+		return i18n.LimitChat
+	case limitGlobal:
+		return i18n.LimitGlobal
+	}
+
+	return i18n.LimitUser
+}
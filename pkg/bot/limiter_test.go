@@ -0,0 +1,102 @@
+package bot
+
+import (
+	"pocket_guide/pkg/limits"
+	"testing"
+	"time"
+)
+
+// newTestLimiter returns the limiter with the global limits and the clock that is moved by the test
+func newTestLimiter(globalRate float64, globalBurst int) (*limiter, *time.Time) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	l := &limiter{
+		limits: limits.Limits{GlobalRate: globalRate, GlobalBurst: globalBurst},
+		now:    func() time.Time { return now },
+	}
+
+	return l, &now
+}
+
+// expect checks the scopes returned by the requests of the user in the chat one after another
+func expect(t *testing.T, l *limiter, tier limits.Tier, userId, chatId int64, want ...limitScope) {
+	t.Helper()
+
+	for i, scope := range want {
+		if got := l.allow(tier, userId, chatId); got != scope {
+			t.Fatalf("request %d of user %d in chat %d: scope %d, want %d", i+1, userId, chatId, got, scope)
+		}
+	}
+}
+
+func TestLimiterBurstAndRefill(t *testing.T) {
+	l, now := newTestLimiter(0, 0)
+	// A token every 10 seconds
+	tier := limits.Tier{UserRate: 6, UserBurst: 2}
+
+	expect(t, l, tier, 1, 1, limitNone, limitNone, limitUser)
+
+	*now = now.Add(5 * time.Second)
+	expect(t, l, tier, 1, 1, limitUser)
+	*now = now.Add(5 * time.Second)
+	expect(t, l, tier, 1, 1, limitNone, limitUser)
+
+	// The bucket is never filled over the burst
+	*now = now.Add(time.Hour)
+	expect(t, l, tier, 1, 1, limitNone, limitNone, limitUser)
+
+	// The other users have their own buckets
+	expect(t, l, tier, 2, 2, limitNone, limitNone, limitUser)
+}
+
+func TestLimiterChat(t *testing.T) {
+	l, _ := newTestLimiter(0, 0)
+	tier := limits.Tier{UserRate: 6, UserBurst: 2, ChatRate: 6, ChatBurst: 1}
+
+	expect(t, l, tier, 1, 10, limitNone, limitChat)
+	expect(t, l, tier, 2, 10, limitChat)
+	// Nothing has been taken from the users rejected by the chat limit
+	expect(t, l, tier, 2, 20, limitNone)
+	expect(t, l, tier, 2, 30, limitNone, limitUser)
+}
+
+func TestLimiterGlobal(t *testing.T) {
+	l, now := newTestLimiter(6, 2)
+	tier := limits.Tier{UserRate: 6, UserBurst: 5}
+
+	expect(t, l, tier, 1, 1, limitNone)
+	expect(t, l, tier, 2, 2, limitNone)
+	expect(t, l, tier, 3, 3, limitGlobal)
+
+	*now = now.Add(10 * time.Second)
+	expect(t, l, tier, 3, 3, limitNone, limitGlobal)
+	// The user rejected by the global limit has kept the tokens
+	*now = now.Add(time.Hour)
+	expect(t, l, tier, 1, 1, limitNone, limitNone)
+	expect(t, l, tier, 1, 1, limitGlobal)
+}
+
+func TestLimiterWithoutRates(t *testing.T) {
+	l, _ := newTestLimiter(0, 0)
+
+	for i := 0; i < 100; i++ {
+		expect(t, l, limits.Tier{}, 1, 1, limitNone)
+	}
+}
+
+func TestLimiterPrune(t *testing.T) {
+	l, now := newTestLimiter(0, 0)
+	tier := limits.Tier{UserRate: 6, UserBurst: 1}
+
+	expect(t, l, tier, 1, 1, limitNone)
+	*now = now.Add(time.Hour + time.Second)
+	expect(t, l, tier, 2, 2, limitNone)
+
+	l.calls = pruneEvery - 1
+	expect(t, l, tier, 2, 2, limitUser)
+	if _, ok := l.users[1]; ok {
+		t.Error("the idle bucket has been kept")
+	}
+	if _, ok := l.users[2]; !ok {
+		t.Error("the bucket in use has been removed")
+	}
+}
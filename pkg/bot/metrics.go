@@ -0,0 +1,81 @@
+package bot
+
+import (
+	tgWrapper "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The bot metrics, the broker ones are counted by pkg/broker
+var (
+	updatesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "guide_bot_updates_received_total",
+		Help: "Telegram updates received by the bot.",
+	}, []string{"type"})
+	updatesInflight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "guide_bot_updates_inflight",
+		Help: "Telegram updates being handled right now.",
+	})
+	telegramErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "guide_bot_telegram_send_errors_total",
+		Help: "Failed requests to the telegram api.",
+	}, []string{"method"})
+)
+
+// send is bot.Send counting the failures
+func (b *Bot) send(c tgWrapper.Chattable) (tgWrapper.Message, error) {
+	msg, err := b.bot.Send(c)
+	if err != nil {
+		telegramErrors.WithLabelValues(method(c)).Inc()
+	}
+
+	return msg, err
+}
+
+// request is bot.Request counting the failures
+func (b *Bot) request(c tgWrapper.Chattable) (*tgWrapper.APIResponse, error) {
+	resp, err := b.bot.Request(c)
+	if err != nil {
+		telegramErrors.WithLabelValues(method(c)).Inc()
+	}
+
+	return resp, err
+}
+
+// method returns the name of the telegram api method of the request
+func method(c tgWrapper.Chattable) string {
+	switch c.(type) {
+	case tgWrapper.MessageConfig:
+		return "sendMessage"
+	case tgWrapper.EditMessageTextConfig:
+		return "editMessageText"
+	case tgWrapper.ChatActionConfig:
+		return "sendChatAction"
+	case tgWrapper.SetMyCommandsConfig:
+		return "setMyCommands"
+	case tgWrapper.DeleteWebhookConfig:
+		return "deleteWebhook"
+	}
+
+	return "other"
+}
+
+// updateType returns the kind of the update for the metrics
+func updateType(update tgWrapper.Update) string {
+	switch {
+	case update.Message != nil && update.Message.IsCommand():
+		return "command"
+	case update.Message != nil && update.Message.Voice != nil:
+		return "voice"
+	case update.Message != nil && len(update.Message.Photo) != 0:
+		return "photo"
+	case update.Message != nil:
+		return "message"
+	case update.EditedMessage != nil:
+		return "edited_message"
+	case update.CallbackQuery != nil:
+		return "callback_query"
+	}
+
+	return "other"
+}
@@ -4,14 +4,113 @@ package bot
 
 import (
 	tgWrapper "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"net/http"
 	"pocket_guide/pkg/broker"
+	"pocket_guide/pkg/config"
+	"pocket_guide/pkg/i18n"
+	"pocket_guide/pkg/limits"
 	"pocket_guide/pkg/logging"
+	"pocket_guide/pkg/storage"
+	"sync"
+	"time"
 )
 
 type Bot struct {
-	bot      *tgWrapper.BotAPI
-	Consumer broker.Broker
-	Producer broker.Broker
-	log      logging.Log
-	err      error
+	bot *tgWrapper.BotAPI
+	// cmdMu guards the command registry, the commands may be registered while the updates are handled
+	cmdMu    sync.RWMutex
+	commands map[string]Command
+	cmdOrder []string
+	streams  streams
+	pending  pending
+	limiter  limiter
+	texts    i18n.Catalog
+	langs    languages
+	handlers sync.WaitGroup
+	cfg      config.Bot
+	server   *http.Server
+	updates  chan tgWrapper.Update
+	// stopping is closed when the webhook stops, sending guards the updates channel from being closed
+	// while a request is sending to it
+	stopping chan struct{}
+	sending  sync.RWMutex
+	// quiet is closed by StopListener, the typing statuses are not shown during the shutdown
+	quiet chan struct{}
+	// aiTimeout is the time limit of one AI request, the typing status is not shown for longer
+	aiTimeout time.Duration
+	Consumer  broker.Consumer
+	Producer  broker.Publisher
+	Storage   storage.Storage
+	log       logging.Log
+	err       error
+}
+
+// CommandHandler is a function that processes a command message,
+// args contains the whitespace-separated command arguments
+type CommandHandler func(msg *tgWrapper.Message, args []string) error
+
+// Command describes a slash command supported by the bot.
+// MinArgs and MaxArgs bound the number of arguments, MaxArgs < 0 means no upper limit
+type Command struct {
+	Name        string
+	Description string
+	// DescriptionKey is the translated description, it replaces Description if set
+	DescriptionKey i18n.Key
+	Usage          string
+	MinArgs        int
+	MaxArgs        int
+	Handler        CommandHandler
+}
+
+// streams tracks the answers that are being edited in place
+type streams struct {
+	mu    sync.Mutex
+	items map[string]*streamState
+}
+
+// streamState is the progress of one answer, seq is the last applied chunk
+type streamState struct {
+	mu       sync.Mutex
+	seq      int
+	text     string
+	lastEdit time.Time
+	done     bool
+	stop     chan struct{}
+}
+
+// pending tracks the requests waiting for an answer from the AI service
+type pending struct {
+	mu    sync.Mutex
+	items map[string]pendingReq
+}
+
+// pendingReq is a request sent to the AI service with the time its answer is expected by
+type pendingReq struct {
+	request  broker.UserMsg
+	deadline time.Time
+}
+
+// limiter rejects the AI requests above the rates of the user tier and the global rate
+type limiter struct {
+	mu     sync.Mutex
+	limits limits.Limits
+	users  map[int64]*bucket
+	chats  map[int64]*bucket
+	global bucket
+	calls  int
+	// now is the clock of the buckets, the tests set their own clock
+	now func() time.Time
+}
+
+// languages remembers the reply language chosen by each user with /language,
+// an empty value means the user has no preference
+type languages struct {
+	mu    sync.Mutex
+	items map[int64]string
+}
+
+// bucket is a token bucket, one token is taken by each request
+type bucket struct {
+	tokens float64
+	last   time.Time
 }
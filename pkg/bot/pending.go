@@ -0,0 +1,78 @@
+package bot
+
+import (
+	"context"
+	"pocket_guide/pkg/broker"
+	"pocket_guide/pkg/i18n"
+	"time"
+)
+
+// pendingCheckInterval is how often the deadlines of the pending requests are checked
+const pendingCheckInterval = 5 * time.Second
+
+// add starts tracking the request sent to the AI service
+func (p *pending) add(request broker.UserMsg, timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.items == nil {
+		p.items = make(map[string]pendingReq)
+	}
+	p.items[request.CorrelationId] = pendingReq{
+		request:  request,
+		deadline: time.Now().Add(timeout),
+	}
+}
+
+// remove stops tracking the request, it has been answered
+func (p *pending) remove(correlationId string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.items, correlationId)
+}
+
+// expired removes and returns the requests whose deadline has passed
+func (p *pending) expired(now time.Time) []broker.UserMsg {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var requests []broker.UserMsg
+	for id, item := range p.items {
+		if now.After(item.deadline) {
+			requests = append(requests, item.request)
+			delete(p.items, id)
+		}
+	}
+
+	return requests
+}
+
+// watchPending notifies users whose questions the AI service has never answered
+// until the context is cancelled
+func (b *Bot) watchPending(ctx context.Context) {
+	ticker := time.NewTicker(pendingCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			b.notifyExpired(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// notifyExpired tells the users that the questions expired by now will not be answered
+func (b *Bot) notifyExpired(now time.Time) {
+	for _, request := range b.pending.expired(now) {
+		b.log.Error("notifyExpired(): No answer from AI service", "correlation_id", request.CorrelationId)
+
+		// The notice is the final answer, so late chunks of the real one are dropped
+		request.Data = b.texts.Text(request.LanguageCode, i18n.NoAnswer)
+		request.Partial = false
+		request.Seq = 0
+		b.deliver(request)
+	}
+}
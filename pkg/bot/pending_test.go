@@ -0,0 +1,48 @@
+package bot
+
+import (
+	"pocket_guide/pkg/broker"
+	"pocket_guide/pkg/i18n"
+	"testing"
+	"time"
+)
+
+func TestNotifyExpired(t *testing.T) {
+	b := newTestBot(t)
+	if err := b.texts.NewCatalog(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := broker.UserMsg{CorrelationId: "c1", ChatId: 10, ReplyId: 5, LanguageCode: "en"}
+	b.pending.add(request, time.Minute)
+	b.pending.add(broker.UserMsg{CorrelationId: "c2", ChatId: 10, ReplyId: 6}, time.Hour)
+
+	// Only the request whose deadline has passed is expired
+	b.notifyExpired(time.Now().Add(2 * time.Minute))
+	if _, ok := b.pending.items["c1"]; ok {
+		t.Error("the expired request is still pending")
+	}
+	if _, ok := b.pending.items["c2"]; !ok {
+		t.Error("the request within its deadline is not pending")
+	}
+
+	st := b.streams.get("c1")
+	st.mu.Lock()
+	text, done := st.text, st.done
+	st.mu.Unlock()
+	if want := b.texts.Text("en", i18n.NoAnswer); text != want || !done {
+		t.Fatalf("answer state = %q %v, want the final %q", text, done, want)
+	}
+
+	// The answer coming after the notice is dropped
+	late := request
+	late.Data = "Big Ben is a clock tower."
+	late.Seq = 3
+	b.deliver(late)
+	st.mu.Lock()
+	text = st.text
+	st.mu.Unlock()
+	if want := b.texts.Text("en", i18n.NoAnswer); text != want {
+		t.Errorf("answer = %q, want the notice %q", text, want)
+	}
+}
@@ -0,0 +1,29 @@
+package bot
+
+import (
+	tgWrapper "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"pocket_guide/pkg/broker"
+)
+
+// photo returns the reference to the largest size of the photo, telegram sends every photo
+// in several sizes. The AI service downloads it
+func photo(msg *tgWrapper.Message) *broker.Photo {
+	if len(msg.Photo) == 0 {
+		return nil
+	}
+
+	best := msg.Photo[0]
+	for _, size := range msg.Photo[1:] {
+		if size.Width*size.Height > best.Width*best.Height {
+			best = size
+		}
+	}
+
+	return &broker.Photo{
+		FileId:   best.FileID,
+		UniqueId: best.FileUniqueID,
+		Width:    best.Width,
+		Height:   best.Height,
+		Size:     best.FileSize,
+	}
+}
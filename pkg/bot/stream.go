@@ -0,0 +1,184 @@
+package bot
+
+import (
+	tgWrapper "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"pocket_guide/pkg/broker"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// editInterval keeps placeholder edits within the telegram limits
+const editInterval = time.Second
+
+// streamTtl is how long a finished answer is remembered,
+// so late partial chunks can't overwrite it
+const streamTtl = time.Minute
+
+// maxMsgLen is the telegram limit for the message text
+const maxMsgLen = 4096
+
+// typingInterval is shorter than the 5 seconds telegram shows the typing status for
+const typingInterval = 4 * time.Second
+
+// deliver sends the AI answer to the chat. Answers with a placeholder are edited in place:
+// partial chunks are throttled and outdated ones are dropped, the final one is always applied
+func (b *Bot) deliver(data broker.UserMsg) {
+	log := b.log.With("chat_id", data.ChatId, "correlation_id", data.CorrelationId)
+	st := b.streams.get(data.CorrelationId)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// Chunks are handled concurrently, so they may come out of order
+	if st.done || (data.Seq != 0 && data.Seq <= st.seq) {
+		return
+	}
+
+	// Without a placeholder there is nothing to edit, only the final answer is sent
+	if data.ReplyId == 0 {
+		if !data.Partial {
+			st.finish()
+			b.streams.forget(data.CorrelationId)
+			b.sendLong(data, splitText(data.Data, maxMsgLen))
+		}
+		return
+	}
+
+	if data.Partial && time.Since(st.lastEdit) < editInterval {
+		return
+	}
+	st.seq = data.Seq
+
+	var text string
+	var parts []string
+	if data.Partial {
+		// Leaving room for the mark of an unfinished answer
+		text = splitText(data.Data, maxMsgLen-2)[0] + " …"
+	} else {
+		parts = splitText(data.Data, maxMsgLen)
+		text = parts[0]
+	}
+
+	if text != st.text {
+		_, err := b.send(tgWrapper.NewEditMessageText(data.ChatId, data.ReplyId, text))
+		if err != nil {
+			log.Error("deliver(): Unable to edit a message in telegram", "err", err)
+			// The placeholder may have been deleted, the final answer is sent as a new message
+			if !data.Partial {
+				st.finish()
+				b.streams.forget(data.CorrelationId)
+				b.sendLong(data, parts)
+			}
+			return
+		}
+		st.text = text
+		st.lastEdit = time.Now()
+	}
+
+	if !data.Partial {
+		st.finish()
+		b.streams.forget(data.CorrelationId)
+		b.sendLong(data, parts[1:])
+	}
+}
+
+// keepTyping shows the typing status in the chat until the answer is finished, the AI timeout passes
+// or the bot stops listening. The state of the answer stays until the final message
+// or the pending timeout delivers it, so the late partial answers still edit the placeholder
+func (b *Bot) keepTyping(chatId int64, id string) {
+	st := b.streams.get(id)
+	ticker := time.NewTicker(typingInterval)
+	defer ticker.Stop()
+	timeout := time.After(b.aiTimeout)
+
+	for {
+		_, err := b.request(tgWrapper.NewChatAction(chatId, tgWrapper.ChatTyping))
+		if err != nil {
+			b.log.Error("keepTyping(): Unable to send chat action", "err", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-st.stop:
+			return
+		case <-timeout:
+			return
+		case <-b.quiet:
+			return
+		}
+	}
+}
+
+// finish marks the answer as delivered and stops the typing status
+func (st *streamState) finish() {
+	if !st.done {
+		st.done = true
+		close(st.stop)
+	}
+}
+
+// sendLong sends the parts of a long answer one by one
+func (b *Bot) sendLong(data broker.UserMsg, parts []string) {
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+
+		msg := tgWrapper.NewMessage(data.ChatId, part)
+		// Answering the question in its thread, even if the question was deleted
+		msg.ReplyToMessageID = data.MessageId
+		msg.AllowSendingWithoutReply = true
+
+		_, err := b.send(msg)
+		if err != nil {
+			b.log.Error("sendLong(): Unable to send a message to telegram", "err", err)
+			return
+		}
+	}
+}
+
+// get returns the state of the answer, creating it on the first chunk
+func (s *streams) get(id string) *streamState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.items == nil {
+		s.items = make(map[string]*streamState)
+	}
+	st, ok := s.items[id]
+	if !ok {
+		st = &streamState{stop: make(chan struct{})}
+		s.items[id] = st
+	}
+
+	return st
+}
+
+// forget removes the finished answer after streamTtl
+func (s *streams) forget(id string) {
+	time.AfterFunc(streamTtl, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.items, id)
+	})
+}
+
+// splitText cuts the text into parts of at most limit characters,
+// preferring to break at line ends
+func splitText(text string, limit int) []string {
+	var parts []string
+
+	for utf8.RuneCountInString(text) > limit {
+		runes := []rune(text)
+		cut := string(runes[:limit])
+		if i := strings.LastIndex(cut, "\n"); i > 0 {
+			cut = cut[:i]
+		}
+		text = strings.TrimLeft(text[len(cut):], "\n")
+		// The blank lines around the break are dropped
+		parts = append(parts, strings.TrimRight(cut, "\n"))
+	}
+
+	return append(parts, text)
+}
@@ -0,0 +1,254 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	tgWrapper "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"io"
+	"net/http"
+	"pocket_guide/pkg/broker"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeepTypingKeepsAnswerState(t *testing.T) {
+	b := newTestBot(t)
+	b.aiTimeout = 50 * time.Millisecond
+
+	stopped := make(chan struct{})
+	go func() {
+		b.keepTyping(10, "c1")
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepTyping() has not stopped after the AI timeout")
+	}
+
+	// A partial answer coming after the typing has stopped still edits the placeholder
+	b.deliver(broker.UserMsg{CorrelationId: "c1", ChatId: 10, ReplyId: 5, Data: "Big Ben", Partial: true, Seq: 1})
+	st := b.streams.get("c1")
+	st.mu.Lock()
+	seq, text, done := st.seq, st.text, st.done
+	st.mu.Unlock()
+	if seq != 1 || text != "Big Ben …" || done {
+		t.Errorf("answer state = %d %q %v, want the partial answer applied", seq, text, done)
+	}
+
+	b.deliver(broker.UserMsg{CorrelationId: "c1", ChatId: 10, ReplyId: 5, Data: "Big Ben is a clock tower.", Seq: 2})
+	select {
+	case <-st.stop:
+	default:
+		t.Error("the final answer has not finished the answer")
+	}
+}
+
+func TestKeepTypingStopsOnShutdown(t *testing.T) {
+	b := newTestBot(t)
+	b.aiTimeout = time.Minute
+	b.quiet = make(chan struct{})
+
+	stopped := make(chan struct{})
+	go func() {
+		b.keepTyping(10, "c1")
+		close(stopped)
+	}()
+	close(b.quiet)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepTyping() has not stopped after StopListener()")
+	}
+}
+
+// actionTransport counts the chat actions sent to telegram
+type actionTransport struct {
+	next    http.RoundTripper
+	actions int32
+}
+
+func (t *actionTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(r.URL.Path, "/sendChatAction") {
+		atomic.AddInt32(&t.actions, 1)
+	}
+
+	return t.next.RoundTrip(r)
+}
+
+// failingPublisher never publishes
+type failingPublisher struct {
+	broker.MemoryBroker
+}
+
+func (p *failingPublisher) PublishRequest(msg []byte, qname, replyTo, correlationId string, ctx context.Context) error {
+	return errors.New("broker is not available")
+}
+
+func TestMsg2AiNoTypingOnFailure(t *testing.T) {
+	b := newTestBot(t)
+	if err := b.texts.NewCatalog(); err != nil {
+		t.Fatal(err)
+	}
+	b.aiTimeout = time.Minute
+	transport := &actionTransport{next: http.DefaultTransport}
+	b.bot.Client.(*http.Client).Transport = transport
+	b.Producer = &failingPublisher{}
+
+	update := tgWrapper.Update{Message: &tgWrapper.Message{
+		MessageID: 7,
+		Chat:      &tgWrapper.Chat{ID: 10, Type: "private"},
+		Text:      "What is Big Ben?",
+	}}
+	if err := b.msg2Ai(update, "", "en"); err == nil {
+		t.Fatal("msg2Ai() has not failed")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if actions := atomic.LoadInt32(&transport.actions); actions != 0 {
+		t.Errorf("%d chat actions have been sent for the failed request", actions)
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  []string
+	}{
+		{name: "under the limit", text: "short answer", limit: 20, want: []string{"short answer"}},
+		{name: "at the limit", text: "abcde", limit: 5, want: []string{"abcde"}},
+		{name: "no newline", text: "abcdefghij", limit: 4, want: []string{"abcd", "efgh", "ij"}},
+		{name: "newline", text: "first line\nsecond line", limit: 15, want: []string{"first line", "second line"}},
+		{name: "blank lines", text: "first\n\n\nsecond", limit: 8, want: []string{"first", "second"}},
+		{name: "multibyte runes", text: "Привет, мир", limit: 7, want: []string{"Привет,", " мир"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := splitText(test.text, test.limit)
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("parts %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// callTransport remembers the edited and the sent texts, the edits fail if failEdits is set
+type callTransport struct {
+	next      http.RoundTripper
+	failEdits bool
+	calls     []string
+}
+
+func (t *callTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	if method != "editMessageText" && method != "sendMessage" {
+		return t.next.RoundTrip(r)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	t.calls = append(t.calls, method+": "+r.PostForm.Get("text"))
+	if method == "editMessageText" && t.failEdits {
+		return &http.Response{
+			StatusCode: http.StatusBadRequest,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body: io.NopCloser(strings.NewReader(
+				`{"ok":false,"error_code":400,"description":"Bad Request: message to edit not found"}`)),
+			Request: r,
+		}, nil
+	}
+
+	// The form has been read, the request is sent without a body
+	r.Body = io.NopCloser(strings.NewReader(r.PostForm.Encode()))
+	return t.next.RoundTrip(r)
+}
+
+func TestDeliver(t *testing.T) {
+	long := strings.Repeat("a", maxMsgLen-1) + "\n" + "tail"
+	chunk := func(seq int, text string, partial bool) broker.UserMsg {
+		return broker.UserMsg{CorrelationId: "id", ChatId: 10, ReplyId: 5, Seq: seq, Data: text, Partial: partial}
+	}
+
+	tests := []struct {
+		name string
+		// chunks are delivered one by one, the throttle has passed before the chunks marked as late
+		chunks    []broker.UserMsg
+		late      []bool
+		failEdits bool
+		want      []string
+	}{
+		{
+			name:   "chunks in order",
+			chunks: []broker.UserMsg{chunk(1, "Big", true), chunk(2, "Big Ben", true), chunk(3, "Big Ben is a bell", false)},
+			late:   []bool{false, true, true},
+			want: []string{"editMessageText: Big …", "editMessageText: Big Ben …",
+				"editMessageText: Big Ben is a bell"},
+		},
+		{
+			name:   "partial chunks throttled",
+			chunks: []broker.UserMsg{chunk(1, "Big", true), chunk(2, "Big Ben", true), chunk(3, "Big Ben is a bell", false)},
+			late:   []bool{false, false, false},
+			want:   []string{"editMessageText: Big …", "editMessageText: Big Ben is a bell"},
+		},
+		{
+			name:   "outdated chunk dropped",
+			chunks: []broker.UserMsg{chunk(2, "Big Ben", true), chunk(1, "Big", true), chunk(3, "Big Ben is a bell", false)},
+			late:   []bool{false, true, true},
+			want:   []string{"editMessageText: Big Ben …", "editMessageText: Big Ben is a bell"},
+		},
+		{
+			name:   "chunk after the final answer dropped",
+			chunks: []broker.UserMsg{chunk(2, "Big Ben is a bell", false), chunk(3, "Big Ben", true)},
+			late:   []bool{false, true},
+			want:   []string{"editMessageText: Big Ben is a bell"},
+		},
+		{
+			name:      "failed edit sent as a new message",
+			chunks:    []broker.UserMsg{chunk(1, "Big Ben is a bell", false)},
+			late:      []bool{false},
+			failEdits: true,
+			want:      []string{"editMessageText: Big Ben is a bell", "sendMessage: Big Ben is a bell"},
+		},
+		{
+			name:   "long answer split",
+			chunks: []broker.UserMsg{chunk(1, long, false)},
+			late:   []bool{false},
+			want:   []string{"editMessageText: " + strings.Repeat("a", maxMsgLen-1), "sendMessage: tail"},
+		},
+		{
+			name: "no placeholder",
+			chunks: []broker.UserMsg{{CorrelationId: "id", ChatId: 10, Seq: 1, Data: "Big", Partial: true},
+				{CorrelationId: "id", ChatId: 10, Seq: 2, Data: "Big Ben", Partial: false}},
+			late: []bool{false, true},
+			want: []string{"sendMessage: Big Ben"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBot(t)
+			transport := &callTransport{next: http.DefaultTransport, failEdits: test.failEdits}
+			b.bot.Client.(*http.Client).Transport = transport
+
+			for i, data := range test.chunks {
+				if test.late[i] {
+					st := b.streams.get("id")
+					st.mu.Lock()
+					st.lastEdit = st.lastEdit.Add(-editInterval)
+					st.mu.Unlock()
+				}
+				b.deliver(data)
+			}
+
+			if strings.Join(transport.calls, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("calls %q, want %q", transport.calls, test.want)
+			}
+		})
+	}
+}
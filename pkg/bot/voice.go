@@ -0,0 +1,19 @@
+package bot
+
+import (
+	tgWrapper "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"pocket_guide/pkg/broker"
+)
+
+// voice returns the reference to the audio of the voice message, the AI service downloads it
+func voice(msg *tgWrapper.Message) *broker.Voice {
+	if msg.Voice == nil {
+		return nil
+	}
+
+	return &broker.Voice{
+		FileId:   msg.Voice.FileID,
+		MimeType: msg.Voice.MimeType,
+		Duration: msg.Voice.Duration,
+	}
+}
@@ -0,0 +1,144 @@
+package bot
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	tgWrapper "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// secretHeader carries the secret token telegram sends with every webhook request
+const secretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// startWebhook starts the HTTP server receiving updates and registers it in telegram
+func (b *Bot) startWebhook() error {
+	link, err := url.Parse(b.cfg.WebhookUrl)
+	if err != nil {
+		return err
+	}
+	path := link.Path
+	if path == "" {
+		path = "/"
+	}
+
+	// Listening before registering, so telegram never calls a closed port
+	listener, err := net.Listen("tcp", b.cfg.WebhookListen)
+	if err != nil {
+		return err
+	}
+
+	b.updates = make(chan tgWrapper.Update, b.cfg.QueueDepth)
+	b.stopping = make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, b.webhookHandler)
+	b.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		var err error
+		if b.cfg.WebhookCert != "" {
+			err = b.server.ServeTLS(listener, b.cfg.WebhookCert, b.cfg.WebhookKey)
+		} else {
+			err = b.server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			b.log.Error("startWebhook(): Webhook server has failed", "err", err)
+		}
+	}()
+	b.log.Info("startWebhook(): Webhook server is listening", "listen", b.cfg.WebhookListen)
+
+	err = b.setWebhook()
+	if err != nil {
+		b.server.Close()
+		return err
+	}
+	b.log.Info("startWebhook(): Webhook has been registered", "url", link.Host+path)
+
+	return nil
+}
+
+// setWebhook registers the webhook url with the secret token,
+// the certificate is uploaded for self-signed setups
+func (b *Bot) setWebhook() error {
+	params := make(tgWrapper.Params)
+	params["url"] = b.cfg.WebhookUrl
+	params["secret_token"] = b.cfg.WebhookSecret
+
+	var err error
+	if b.cfg.WebhookUploadCert {
+		_, err = b.bot.UploadFiles("setWebhook", params, []tgWrapper.RequestFile{
+			{Name: "certificate", Data: tgWrapper.FilePath(b.cfg.WebhookCert)},
+		})
+	} else {
+		_, err = b.bot.MakeRequest("setWebhook", params)
+	}
+
+	return err
+}
+
+// stopWebhook unregisters the webhook, waits for the running requests
+// and closes the updates channel
+func (b *Bot) stopWebhook(ctx context.Context) error {
+	_, err := b.request(tgWrapper.DeleteWebhookConfig{})
+	if err != nil {
+		b.log.Error("stopWebhook(): Unable to delete webhook", "err", err)
+	} else {
+		b.log.Info("stopWebhook(): Webhook has been deleted")
+	}
+
+	err = b.server.Shutdown(ctx)
+	if err != nil {
+		b.log.Error("stopWebhook(): Unable to stop webhook server", "err", err)
+		b.server.Close()
+	}
+
+	// The requests still running after Close give up before the channel is closed,
+	// so the workers always stop
+	close(b.stopping)
+	b.sending.Lock()
+	close(b.updates)
+	b.sending.Unlock()
+
+	return err
+}
+
+// webhookHandler accepts the updates sent by telegram after checking the secret token
+func (b *Bot) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	secret := r.Header.Get(secretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(b.cfg.WebhookSecret)) != 1 {
+		b.log.Error("webhookHandler(): Request with a wrong secret token", "remote_addr", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	var update tgWrapper.Update
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&update)
+	if err != nil {
+		b.log.Error("webhookHandler(): Unable to convert from json", "err", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Telegram resends the update if it is not accepted in time
+	b.sending.RLock()
+	defer b.sending.RUnlock()
+	select {
+	case b.updates <- update:
+		w.WriteHeader(http.StatusOK)
+	case <-b.stopping:
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,106 @@
+package bot
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	tgWrapper "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestStopWebhookClosesUpdates(t *testing.T) {
+	b := newTestBot(t)
+	if err := b.startWebhook(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first update fills the queue, the second one waits in the handler,
+	// so the server can't shut down gracefully
+	b.updates <- tgWrapper.Update{UpdateID: 1}
+	request, err := http.NewRequest(http.MethodPost, "http://"+b.cfg.WebhookListen+"/hook",
+		strings.NewReader(`{"update_id":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(secretHeader, "secret")
+	handled := make(chan struct{})
+	go func() {
+		response, err := http.DefaultClient.Do(request)
+		if err == nil {
+			response.Body.Close()
+		}
+		close(handled)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.stopWebhook(ctx); err == nil {
+		t.Error("stopWebhook() has not reported the request that was still running")
+	}
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiting request has not given up")
+	}
+
+	var ids []int
+	for update := range b.updates {
+		ids = append(ids, update.UpdateID)
+	}
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Errorf("updates %v, want [1]", ids)
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		secret string
+		body   string
+		status int
+	}{
+		{name: "update", method: http.MethodPost, secret: "secret", body: `{"update_id":7}`, status: http.StatusOK},
+		{name: "missing secret", method: http.MethodPost, body: `{"update_id":7}`, status: http.StatusUnauthorized},
+		{name: "wrong secret", method: http.MethodPost, secret: "secreT", body: `{"update_id":7}`,
+			status: http.StatusUnauthorized},
+		{name: "not a post", method: http.MethodGet, secret: "secret", status: http.StatusMethodNotAllowed},
+		{name: "malformed body", method: http.MethodPost, secret: "secret", body: `{"update_id":`,
+			status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBot(t)
+			b.updates = make(chan tgWrapper.Update, 1)
+			b.stopping = make(chan struct{})
+
+			request := httptest.NewRequest(test.method, "/hook", strings.NewReader(test.body))
+			if test.secret != "" {
+				request.Header.Set(secretHeader, test.secret)
+			}
+			response := httptest.NewRecorder()
+			b.webhookHandler(response, request)
+
+			if response.Code != test.status {
+				t.Errorf("status %d, want %d", response.Code, test.status)
+			}
+			// Only the accepted update reaches the handlers
+			select {
+			case update := <-b.updates:
+				if test.status != http.StatusOK || update.UpdateID != 7 {
+					t.Errorf("update %d has been queued, status %d", update.UpdateID, test.status)
+				}
+			default:
+				if test.status == http.StatusOK {
+					t.Error("update has not been queued")
+				}
+			}
+		})
+	}
+}
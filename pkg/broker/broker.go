@@ -3,244 +3,495 @@ package broker
 // Ivan Orshak, 12.07.2023
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
-	"os"
-	"strconv"
-	"strings"
+	"pocket_guide/pkg/config"
+	"sync"
+	"time"
 )
 
-// NewBroker is a method that initializes its own logging system,
-// creates a connection and a channel with the broker,
-// loads configuration file
-func (b *Broker) NewBroker() error {
+// dlqSuffix is appended to the queue name to get its dead-letter queue
+const dlqSuffix = ".dlq"
+
+// retryHeader counts the redeliveries of a message
+const retryHeader = "x-retry-count"
+
+// NewBroker is a method that initializes its own logging system
+// and creates a connection and a channel with the broker
+func (b *AmqpBroker) NewBroker(cfg config.Broker) error {
 	// Logging layer
 	b.log.NewLog("logs/broker/")
 
 	// Initializing map queues
-	b.queues = make(map[string]amqp.Queue)
-
-	// Trying to connect over TCP with broker service
-	var brokerUrl string
-	brokerUrl, b.err = b.getConfig("BROKER_URL")
+	b.queues = make(map[string]struct{})
+	b.cfg = cfg
+	if b.dial == nil {
+		b.dial = dialAmqp
+	}
 
-	b.conn, b.err = amqp.Dial(brokerUrl)
+	b.done = make(chan struct{})
+	b.ready = make(chan struct{})
+	b.err = b.connect()
 	if b.err != nil {
-		b.log.LogErr.Println("NewBroker(): Unable to connect over TCP, error:", b.err)
+		b.log.Error("NewBroker(): Unable to connect to the broker", "err", b.err)
 		return b.err
+	}
+	close(b.ready)
+
+	// Watching the connection and restoring it when the broker goes away
+	go b.watch()
+
+	return nil
+}
+
+// amqpConnection adapts the RabbitMQ connection to amqpConn
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+// Channel opens a new channel on the connection
+func (c amqpConnection) Channel() (amqpChannel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+// dialAmqp connects to RabbitMQ
+func dialAmqp(url string) (amqpConn, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return amqpConnection{conn}, nil
+}
+
+// connect creates a connection and a channel with the broker
+func (b *AmqpBroker) connect() error {
+	conn, err := b.dial(b.cfg.Url)
+	if err != nil {
+		b.log.Error("connect(): Unable to connect over TCP", "err", err)
+		return err
 	} else {
-		b.log.LogInfo.Println("NewBroker(): Connected to:", brokerUrl)
+		b.log.Info("connect(): Connected to the broker")
 	}
 
 	// Trying to create a connection channel with broker service
-	b.ch, b.err = b.conn.Channel()
+	ch, err := conn.Channel()
+	if err != nil {
+		b.log.Error("connect(): Unable to create a connection channel", "err", err)
+		conn.Close()
+		return err
+	} else {
+		b.log.Info("connect(): Connection successfully created")
+	}
+
+	// The previous connection is closed, otherwise its TCP connection would be left open
+	b.mu.Lock()
+	old := b.conn
+	b.conn, b.ch = conn, ch
+	b.lost = make(chan struct{})
+	b.mu.Unlock()
+	if old != nil && !old.IsClosed() {
+		old.Close()
+	}
+
+	return nil
+}
+
+// reopen restores the channel with the broker. Only the channel is replaced if the connection
+// is still open, e.g. after a channel exception, otherwise a new connection is made
+func (b *AmqpBroker) reopen() error {
+	b.mu.RLock()
+	conn := b.conn
+	b.mu.RUnlock()
+
+	if conn != nil && !conn.IsClosed() {
+		ch, err := conn.Channel()
+		if err == nil {
+			b.mu.Lock()
+			b.ch = ch
+			b.lost = make(chan struct{})
+			b.mu.Unlock()
+			b.log.Info("reopen(): Channel has been reopened on the current connection")
+			return nil
+		}
+		b.log.Error("reopen(): Unable to open a channel on the current connection", "err", err)
+	}
+
+	return b.connect()
+}
+
+// MakeQueue is a method that creates a durable queue in the queue map
+// for writing and reading broker messages with the name passed in the method parameter.
+// Every queue gets its own dead-letter queue '<qname>.dlq' for messages that can't be handled
+func (b *AmqpBroker) MakeQueue(qname string) error {
+	b.err = b.declare(qname)
 	if b.err != nil {
-		b.log.LogErr.Println("NewBroker(): Unable to create a connection channel, error:", b.err)
+		b.log.Error("MakeQueue(): Unable to create a queue", "queue", qname, "err", b.err)
 		return b.err
 	} else {
-		b.log.LogInfo.Println("NewBroker(): Connection successfully created.")
+		b.log.Info("MakeQueue(): A queue has been successfully created", "queue", qname)
 	}
 
+	// Remembering the queue to declare it again after reconnection
+	b.mu.Lock()
+	b.queues[qname] = struct{}{}
+	b.mu.Unlock()
+
 	return nil
 }
 
-// MakeQueue is a method that creates a queue in the queue map
-// for writing and reading broker messages with the name passed in the method parameter
-func (b *Broker) MakeQueue(qname string) error {
-	b.queues[qname], b.err = b.ch.QueueDeclare(
+// declare creates the queue on a separate channel, since a queue declared before with other arguments
+// closes the channel it is declared on. Older versions declared the queues non-durable
+// without a dead-letter queue, such a queue is replaced if it has no messages and no consumers
+func (b *AmqpBroker) declare(qname string) error {
+	err := b.withChannel(func(ch amqpChannel) error {
+		return declareQueue(ch, qname)
+	})
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		return err
+	}
+
+	b.log.Info("declare(): Queue has been declared with other arguments, replacing it", "queue", qname, "err", err)
+	err = b.withChannel(func(ch amqpChannel) error {
+		_, err := ch.QueueDelete(qname, true, true, false)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("queue '%s' has been declared by an older version and can't be replaced while it has "+
+			"messages or consumers, stop the old services and let it drain or delete it: %w", qname, err)
+	}
+
+	return b.withChannel(func(ch amqpChannel) error {
+		return declareQueue(ch, qname)
+	})
+}
+
+// withChannel runs fn on a new channel of the current connection and closes the channel
+func (b *AmqpBroker) withChannel(fn func(ch amqpChannel) error) error {
+	b.mu.RLock()
+	conn := b.conn
+	b.mu.RUnlock()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	// The channel is already closed if fn has failed with a channel exception
+	defer ch.Close()
+
+	return fn(ch)
+}
+
+// declareQueue creates the durable queue and its dead-letter queue
+func declareQueue(ch amqpChannel, qname string) error {
+	dlqName := qname + dlqSuffix
+
+	_, err := ch.QueueDeclare(
+		dlqName, // name
+		true,    // durable
+		false,   // delete when unused
+		false,   // exclusive
+		false,   // no-wait
+		nil,     // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = ch.QueueDeclare(
 		qname, // name
-		false, // durable
+		true,  // durable
 		false, // delete when unused
 		false, // exclusive
 		false, // no-wait
-		nil,   // arguments
+		amqp.Table{ // arguments
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": dlqName,
+		},
 	)
-	if b.err != nil {
-		b.log.LogErr.Println("MakeQueue(): Unable to create a queue:", qname, "error:", b.err)
-		return b.err
-	} else {
-		b.log.LogInfo.Println("MakeQueue(): A queue:", qname, "has been successfully created.")
-	}
 
-	return nil
+	return err
 }
 
-// Publish method sends a message to the broker in the queue specified in the input parameters
-func (b *Broker) Publish(msg []byte, qname string, ctx context.Context) error {
-	b.err = b.ch.PublishWithContext(ctx,
-		"",                   // exchange
-		b.queues[qname].Name, // routing key
-		false,                // mandatory
-		false,                // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        msg,
-		})
-	if b.err != nil {
-		b.log.LogErr.Println("Publish(): Unable to publish a message, error:", b.err)
-		return b.err
+// Publish method sends a persistent message to the broker in the queue specified in the input parameters
+func (b *AmqpBroker) Publish(msg []byte, qname string, ctx context.Context) error {
+	return b.publish(qname, amqp.Publishing{Body: msg}, ctx)
+}
+
+// PublishRequest sends a persistent message asking to answer into the replyTo queue,
+// the answers carry the same correlationId
+func (b *AmqpBroker) PublishRequest(msg []byte, qname, replyTo, correlationId string, ctx context.Context) error {
+	return b.publish(qname, amqp.Publishing{
+		Body:          msg,
+		ReplyTo:       replyTo,
+		CorrelationId: correlationId,
+	}, ctx)
+}
+
+// publish sends a persistent message to the queue,
+// while the broker is reconnecting it waits until the context expires
+func (b *AmqpBroker) publish(qname string, msg amqp.Publishing, ctx context.Context) error {
+	err := b.waitReady(ctx)
+	if err != nil {
+		b.log.Error("Publish(): Broker is not connected", "err", err)
+		published(qname, err)
+		return err
+	}
+
+	msg.ContentType = "application/json"
+	msg.DeliveryMode = amqp.Persistent
+
+	err = b.channel().PublishWithContext(ctx,
+		"",    // exchange
+		qname, // routing key
+		false, // mandatory
+		false, // immediate
+		msg)
+	published(qname, err)
+	if err != nil {
+		b.log.Error("Publish(): Unable to publish a message", "err", err)
+		return err
 	}
 
 	return nil
 }
 
-// Consume method infinitely checks for incoming messages
-// from the broker in the queue with the name passed in the input parameters
-func (b *Broker) Consume(qname string, ch chan UserMsg) error {
-	// Channel to connect Consume() with internal goroutine
-	var forever chan struct{}
-	// Channel for incoming broker messages
-	var messages <-chan amqp.Delivery
-	messages, b.err = b.makeConsumeCh(qname)
-	if b.err != nil {
-		b.log.LogErr.Println("Consume(): Unable to consume publishing messages, error:", b.err)
-		return b.err
+// Consume method checks for incoming messages from the broker in the queue
+// with the name passed in the input parameters and runs the handler for each of them
+// in a pool of workers. The broker sends at most workers unacknowledged messages,
+// so the rest of them wait in RabbitMQ instead of memory.
+// A message is acknowledged after the handler succeeds, failed messages are redelivered
+// up to BROKER_MAX_RETRIES times and then moved to the dead-letter queue.
+// Consume survives reconnections. When the context is cancelled it stops receiving messages,
+// waits for the running handlers and returns
+func (b *AmqpBroker) Consume(qname string, workers int, handler Handler, ctx context.Context) error {
+	if workers < 1 {
+		workers = 1
 	}
 
-	// Goroutine for processing each incoming message
-	go func(ch chan UserMsg) {
-		for message := range messages {
-			var msg UserMsg
+	for {
+		// Channel for incoming broker messages, lost tells when the channel it comes from is replaced
+		lost := b.lostCh()
+		ch, messages, tag, err := b.makeConsumeCh(qname, workers)
+		if err == nil {
+			// Cancelling the subscription closes the delivery channel. The subscription is cancelled
+			// on the channel it was made on, the current one may have been replaced by a reconnection
+			stopped := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					err := ch.Cancel(tag, false)
+					if err != nil {
+						b.log.Error("Consume(): Unable to cancel the consumer", "err", err)
+					}
+				case <-stopped:
+				}
+			}()
 
-			b.err = json.Unmarshal(message.Body, &msg)
-			if b.err != nil {
-				b.log.LogErr.Println("Consume(): Unable to convert from json, error:", b.err)
-			} else {
-				ch <- msg
+			// The workers take the messages until the delivery channel is closed
+			var pool sync.WaitGroup
+			for i := 0; i < workers; i++ {
+				pool.Add(1)
+				b.inflight.Add(1)
+				go func() {
+					defer b.inflight.Done()
+					defer pool.Done()
+					for message := range messages {
+						handlersInflight.WithLabelValues(qname).Inc()
+						b.handle(qname, message, handler)
+						handlersInflight.WithLabelValues(qname).Dec()
+					}
+				}()
 			}
+			pool.Wait()
+			close(stopped)
+
+			if ctx.Err() != nil {
+				break
+			}
+			b.log.Error("Consume(): Delivery channel of the queue has been closed", "queue", qname)
+		} else if !ch.IsClosed() {
+			b.log.Error("Consume(): Unable to consume publishing messages", "err", err)
+			return err
 		}
-	}(ch)
 
-	<-forever
+		// The delivery channel is closed with the broker channel, then the reconnection is awaited
+		// once watch() has noticed the loss. A subscription cancelled by the server on an open channel
+		// is simply renewed after a pause
+		var renew <-chan time.Time
+		if !ch.IsClosed() {
+			renew = time.After(minReconnectDelay)
+		}
+		select {
+		case <-lost:
+		case <-renew:
+		case <-ctx.Done():
+		case <-b.done:
+		}
+
+		err = b.waitReady(ctx)
+		if err != nil {
+			break
+		}
+		b.log.Info("Consume(): Consuming of the queue has been resumed", "queue", qname)
+	}
+
+	b.inflight.Wait()
+	b.log.Info("Consume(): Consuming of the queue has been stopped", "queue", qname)
 
 	return nil
 }
 
-// makeConsumeCh is a method that creates a connection channel
-// to the broker to listen to incoming messages
-func (b *Broker) makeConsumeCh(qname string) (<-chan amqp.Delivery, error) {
-	var params [6]string
-	var autoAck, exclusive, noLocal, noWait bool
-	var args amqp.Table
-
-	params[0], b.err = b.getConfig("BROKER_URL")
-	if b.err != nil {
-		b.log.LogErr.Println("makeConsumeCh(): Unable to get BROKER_CONSUMER conf, error:", b.err)
-		return nil, b.err
+// handle decodes the message, runs the handler and settles the delivery
+func (b *AmqpBroker) handle(qname string, message amqp.Delivery, handler Handler) {
+	msg, err := DecodeUserMsg(message.Body)
+	if err != nil {
+		// A malformed message will never be handled, so it goes straight to the dead-letter queue
+		b.log.Error("handle(): Unable to convert from json, message is dead-lettered", "err", err)
+		messagesConsumed.WithLabelValues(qname, "dead").Inc()
+		b.settle(message.Nack(false, false))
+		return
 	}
-	params[1], b.err = b.getConfig("BROKER_CONSUMER_AUTO_ACK")
-	if b.err != nil {
-		b.log.LogErr.Println("makeConsumeCh(): Unable to get BROKER_CONSUMER_AUTO_ACK conf, error:", b.err)
-		return nil, b.err
+	// The message properties take part in the envelope, so handlers don't depend on the transport
+	if msg.ReplyTo == "" {
+		msg.ReplyTo = message.ReplyTo
 	}
-	params[2], b.err = b.getConfig("BROKER_CONSUMER_EXCLUSIVE")
-	if b.err != nil {
-		b.log.LogErr.Println("makeConsumeCh(): Unable to get BROKER_CONSUMER_EXCLUSIVE conf, error:", b.err)
-		return nil, b.err
+	if message.CorrelationId != "" {
+		msg.CorrelationId = message.CorrelationId
 	}
-	params[3], b.err = b.getConfig("BROKER_CONSUMER_NO_LOCAL")
-	if b.err != nil {
-		b.log.LogErr.Println("makeConsumeCh(): Unable to get BROKER_CONSUMER_NO_LOCAL conf, error:", b.err)
-		return nil, b.err
+
+	// A message redelivered by RabbitMQ was taken by a consumer that has crashed or stopped before settling it,
+	// it is counted as a failure, so a message crashing the consumers ends in the dead-letter queue
+	if message.Redelivered {
+		b.retry(qname, message, errRedelivered)
+		return
 	}
-	params[4], b.err = b.getConfig("BROKER_CONSUMER_NO_WAIT")
-	if b.err != nil {
-		b.log.LogErr.Println("makeConsumeCh(): Unable to get BROKER_CONSUMER_NO_WAIT conf, error:", b.err)
-		return nil, b.err
+
+	err = runHandler(handler, msg)
+	if err == nil {
+		messagesConsumed.WithLabelValues(qname, "ack").Inc()
+		b.settle(message.Ack(false))
+		return
 	}
-	params[5], b.err = b.getConfig("BROKER_CONSUMER_ARGS")
-	if b.err != nil {
-		b.log.LogErr.Println("makeConsumeCh(): Unable to get BROKER_CONSUMER_ARGS conf, error:", b.err)
-		return nil, b.err
+	b.retry(qname, message, err)
+}
+
+// retry publishes a copy of the failed message with the increased counter,
+// after maxRetries the message is dead-lettered
+func (b *AmqpBroker) retry(qname string, message amqp.Delivery, err error) {
+	retries := retryCount(message.Headers)
+	if retries >= b.cfg.MaxRetries {
+		b.log.Error("retry(): Message has failed too many times, it is dead-lettered", "queue", qname,
+			"attempts", retries+1, "err", err)
+		messagesConsumed.WithLabelValues(qname, "dead").Inc()
+		b.settle(message.Nack(false, false))
+		return
 	}
 
-	autoAck, b.err = strconv.ParseBool(params[1])
-	if b.err != nil {
-		b.log.LogErr.Println("makeConsumeCh(): Unable to parse bool parameter:", params[4], "error:", b.err)
-		return nil, b.err
+	// Publishing a copy with the increased counter, the original is acknowledged only after that
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	headers := amqp.Table{}
+	for key, value := range message.Headers {
+		headers[key] = value
 	}
-	exclusive, b.err = strconv.ParseBool(params[2])
-	if b.err != nil {
-		b.log.LogErr.Println("makeConsumeCh(): Unable to parse bool parameter", params[4], "error:", b.err)
-		return nil, b.err
+	headers[retryHeader] = int32(retries + 1)
+
+	b.log.Error("retry(): Unable to handle message, retrying", "queue", qname, "retry", retries+1,
+		"max_retries", b.cfg.MaxRetries, "err", err)
+	messagesConsumed.WithLabelValues(qname, "retry").Inc()
+	err = b.publish(qname, amqp.Publishing{
+		Headers:       headers,
+		Body:          message.Body,
+		ReplyTo:       message.ReplyTo,
+		CorrelationId: message.CorrelationId,
+	}, ctx)
+	if err != nil {
+		b.settle(message.Nack(false, true))
+		return
 	}
-	noLocal, b.err = strconv.ParseBool(params[3])
-	if b.err != nil {
-		b.log.LogErr.Println("makeConsumeCh(): Unable to parse bool parameter", params[4], "error:", b.err)
-		return nil, b.err
+	b.settle(message.Ack(false))
+}
+
+// settle logs the result of the message acknowledgement
+func (b *AmqpBroker) settle(err error) {
+	if err != nil {
+		b.log.Error("settle(): Unable to acknowledge a message", "err", err)
 	}
-	noWait, b.err = strconv.ParseBool(params[4])
-	if b.err != nil {
-		b.log.LogErr.Println("makeConsumeCh(): Unable to parse bool parameter", params[4], "error:", b.err)
-		return nil, b.err
-	}
-
-	return b.ch.Consume(
-		b.queues[qname].Name, // queue
-		params[0],            // consumer
-		autoAck,              // auto-ack
-		exclusive,            // exclusive
-		noLocal,              // no-local
-		noWait,               // no-wait
-		args,                 // args
-	)
 }
 
-// Close method closes the connection with the broker and the connection channel
-// and closes configuration file
-func (b *Broker) Close() {
-	// Trying to close broker connection
-	b.err = b.conn.Close()
+// retryCount returns the number of the redeliveries of the message
+func retryCount(headers amqp.Table) int {
+	switch value := headers[retryHeader].(type) {
+	case int32:
+		return int(value)
+	case int64:
+		return int(value)
+	case int:
+		return value
+	}
+
+	return 0
+}
+
+// makeConsumeCh is a method that creates a connection channel
+// to the broker to listen to incoming messages, the broker channel and the consumer tag are returned to cancel it.
+// The prefetch count is the number of workers, so every worker has at most one message
+func (b *AmqpBroker) makeConsumeCh(qname string, prefetch int) (amqpChannel, <-chan amqp.Delivery, string, error) {
+	ch := b.channel()
+
+	// The prefetch is applied to the consumers created after it on this channel
+	b.err = ch.Qos(prefetch, 0, false)
 	if b.err != nil {
-		b.log.LogErr.Println("Close(): Unable to close the connection, error:", b.err)
-	} else {
-		b.log.LogInfo.Println("Close(): The connection was successfully closed.")
+		b.log.Error("makeConsumeCh(): Unable to set prefetch count", "err", b.err)
+		return ch, nil, "", b.err
 	}
 
+	// Messages are acknowledged manually after they have been handled
+	tag := qname + "-" + NewCorrelationId()
+	messages, err := ch.Consume(
+		qname,                   // queue
+		tag,                     // consumer
+		false,                   // auto-ack
+		b.cfg.ConsumerExclusive, // exclusive
+		b.cfg.ConsumerNoLocal,   // no-local
+		b.cfg.ConsumerNoWait,    // no-wait
+		nil,                     // args
+	)
+
+	return ch, messages, tag, err
+}
+
+// Close method closes the connection channel and the connection with the broker
+// and stops the reconnection
+func (b *AmqpBroker) Close() {
+	close(b.done)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	// Trying to close broker channel
 	b.err = b.ch.Close()
 	if b.err != nil {
-		b.log.LogErr.Println("Close(): Unable to close the channel, error:", b.err)
+		b.log.Error("Close(): Unable to close the channel", "err", b.err)
 	} else {
-		b.log.LogInfo.Println("Close(): The channel was successfully closed.")
+		b.log.Info("Close(): The channel was successfully closed")
 	}
-}
 
-// loadConfig is a method that opens a configuration file
-// and searches for the value of the parameter passed in the input parameters
-func (b *Broker) getConfig(param string) (string, error) {
-	// Trying to load configuration file
-	b.cfgF, b.err = os.OpenFile("cfg/.cfg", os.O_RDONLY, 0666)
+	// Trying to close broker connection
+	b.err = b.conn.Close()
 	if b.err != nil {
-		b.log.LogErr.Println("NewBroker(): Unable to open configuration file, error:", b.err)
-		return "", b.err
+		b.log.Error("Close(): Unable to close the connection", "err", b.err)
 	} else {
-		b.log.LogInfo.Println("NewBroker(): Configuration file has been successfully loaded.")
-	}
-	defer func() {
-		// Closing file after work
-		b.err = b.cfgF.Close()
-		if b.err != nil {
-			b.log.LogErr.Println("Unable to close configuration file, error:", b.err)
-		} else {
-			b.log.LogInfo.Println("Close(): The conf file was successfully closed.")
-		}
-	}()
-
-	// Creating the new scanner
-	fileScanner := bufio.NewScanner(b.cfgF)
-	// Read string by string
-	for fileScanner.Scan() {
-		data := strings.Split(fileScanner.Text(), "=")
-		if data[0] == param {
-			return data[1], nil
-		}
+		b.log.Info("Close(): The connection was successfully closed")
 	}
-
-	// If there is not such parameter
-	b.log.LogErr.Println("getConfig(): Parameter is not found.")
-	//return "", errors.New("getConfig(): parameter is not found")
-	return "", nil
 }
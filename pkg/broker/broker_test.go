@@ -0,0 +1,402 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"os"
+	"pocket_guide/pkg/config"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is a connection with the broker that the test can drop
+type fakeConn struct {
+	mu       sync.Mutex
+	closed   bool
+	notify   []chan *amqp.Error
+	channels []*fakeChannel
+}
+
+func (c *fakeConn) Channel() (amqpChannel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &fakeChannel{consumers: make(map[string]chan amqp.Delivery)}
+	c.channels = append(c.channels, ch)
+
+	return ch, nil
+}
+
+func (c *fakeConn) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+func (c *fakeConn) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+func (c *fakeConn) Close() error {
+	c.shut(nil)
+	return nil
+}
+
+// drop closes the connection and its channels as if the server has gone away
+func (c *fakeConn) drop() {
+	c.shut(&amqp.Error{Code: amqp.ConnectionForced, Reason: "connection dropped"})
+}
+
+func (c *fakeConn) shut(reason *amqp.Error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	notify, channels := c.notify, c.channels
+	c.mu.Unlock()
+
+	for _, ch := range channels {
+		ch.shut(reason)
+	}
+	for _, receiver := range notify {
+		if reason != nil {
+			receiver <- reason
+		}
+		close(receiver)
+	}
+}
+
+// fakeChannel is a channel of fakeConn, it remembers the consumers, the cancellations and the acknowledgements
+type fakeChannel struct {
+	mu        sync.Mutex
+	closed    bool
+	notify    []chan *amqp.Error
+	consumers map[string]chan amqp.Delivery
+	cancelled []string
+	acked     int
+}
+
+func (ch *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool,
+	args amqp.Table) (<-chan amqp.Delivery, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	messages := make(chan amqp.Delivery, 1)
+	ch.consumers[consumer] = messages
+
+	return messages, nil
+}
+
+func (ch *fakeChannel) Cancel(consumer string, noWait bool) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.cancelled = append(ch.cancelled, consumer)
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	messages, ok := ch.consumers[consumer]
+	if !ok {
+		return errors.New("unknown consumer " + consumer)
+	}
+	delete(ch.consumers, consumer)
+	close(messages)
+
+	return nil
+}
+
+func (ch *fakeChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool,
+	msg amqp.Publishing) error {
+	return nil
+}
+
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool,
+	args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *fakeChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	return 0, nil
+}
+
+func (ch *fakeChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.notify = append(ch.notify, receiver)
+	return receiver
+}
+
+func (ch *fakeChannel) IsClosed() bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.closed
+}
+
+func (ch *fakeChannel) Close() error {
+	ch.shut(nil)
+	return nil
+}
+
+func (ch *fakeChannel) shut(reason *amqp.Error) {
+	ch.mu.Lock()
+	if ch.closed {
+		ch.mu.Unlock()
+		return
+	}
+	ch.closed = true
+	notify, consumers := ch.notify, ch.consumers
+	ch.consumers = nil
+	ch.mu.Unlock()
+
+	for _, messages := range consumers {
+		close(messages)
+	}
+	for _, receiver := range notify {
+		if reason != nil {
+			receiver <- reason
+		}
+		close(receiver)
+	}
+}
+
+// deliver sends the message to the consumer of the channel
+func (ch *fakeChannel) deliver(t *testing.T, body string) {
+	t.Helper()
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	for _, messages := range ch.consumers {
+		messages <- amqp.Delivery{Acknowledger: ch, Body: []byte(body)}
+		return
+	}
+	t.Fatal("channel has no consumers")
+}
+
+// cancellations returns the consumers the channel has been asked to cancel
+func (ch *fakeChannel) cancellations() []string {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return append([]string(nil), ch.cancelled...)
+}
+
+// tags returns the consumers of the channel
+func (ch *fakeChannel) tags() []string {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	tags := make([]string, 0, len(ch.consumers))
+	for tag := range ch.consumers {
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+func (ch *fakeChannel) Ack(tag uint64, multiple bool) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.acked++
+	return nil
+}
+
+func (ch *fakeChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) Reject(tag uint64, requeue bool) error {
+	return nil
+}
+
+// fakeServer hands out the fake connections
+type fakeServer struct {
+	mu    sync.Mutex
+	conns []*fakeConn
+}
+
+func (s *fakeServer) dial(url string) (amqpConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn := &fakeConn{}
+	s.conns = append(s.conns, conn)
+
+	return conn, nil
+}
+
+// conn returns the connection i once it has been dialed
+func (s *fakeServer) conn(t *testing.T, i int) *fakeConn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		if len(s.conns) > i {
+			conn := s.conns[i]
+			s.mu.Unlock()
+			return conn
+		}
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("connection %d hasn't been dialed", i)
+
+	return nil
+}
+
+// consumer returns the channel of the connection the queue is consumed on and the consumer tag
+func (s *fakeServer) consumer(t *testing.T, i int) (*fakeChannel, string) {
+	t.Helper()
+	conn := s.conn(t, i)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn.mu.Lock()
+		channels := conn.channels
+		conn.mu.Unlock()
+		for _, ch := range channels {
+			if tags := ch.tags(); len(tags) != 0 {
+				return ch, tags[0]
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("queue isn't consumed on connection %d", i)
+
+	return nil, ""
+}
+
+// newFakeBroker returns the broker connected to the fake server, its logs are written to a temporary directory
+func newFakeBroker(t *testing.T) (*AmqpBroker, *fakeServer) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(dir) })
+
+	server := &fakeServer{}
+	b := &AmqpBroker{dial: server.dial}
+	if err := b.NewBroker(config.Broker{MaxRetries: 1}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Close)
+	if err := b.MakeQueue("aiRequest"); err != nil {
+		t.Fatal(err)
+	}
+
+	return b, server
+}
+
+func TestConsumeResumesAfterReconnect(t *testing.T) {
+	b, server := newFakeBroker(t)
+
+	got := make(chan string, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		_ = b.Consume("aiRequest", 2, func(msg UserMsg) error {
+			got <- msg.Data
+			return nil
+		}, ctx)
+		close(stopped)
+	}()
+
+	first, _ := server.consumer(t, 0)
+	first.deliver(t, `{"version":1,"chat_id":5,"text":"before"}`)
+	if text := <-got; text != "before" {
+		t.Errorf("got %q, want before", text)
+	}
+
+	// The consumer subscribes again on the channel of the new connection
+	server.conn(t, 0).drop()
+	second, tag := server.consumer(t, 1)
+	second.deliver(t, `{"version":1,"chat_id":5,"text":"after"}`)
+	select {
+	case text := <-got:
+		if text != "after" {
+			t.Errorf("got %q, want after", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message hasn't been handled after reconnection")
+	}
+
+	cancel()
+	wait(t, stopped, "Consume hasn't returned after cancellation")
+	if len(second.cancelled) != 1 || second.cancelled[0] != tag {
+		t.Errorf("cancelled %v on the new channel, want %s", second.cancelled, tag)
+	}
+	if first.acked != 1 || second.acked != 1 {
+		t.Errorf("acknowledged %d and %d messages, want 1 on every channel", first.acked, second.acked)
+	}
+}
+
+func TestConsumeCancelsOnItsChannel(t *testing.T) {
+	b, server := newFakeBroker(t)
+
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		_ = b.Consume("aiRequest", 1, func(msg UserMsg) error {
+			close(handling)
+			<-release
+			return nil
+		}, ctx)
+		close(stopped)
+	}()
+
+	first, tag := server.consumer(t, 0)
+	first.deliver(t, `{"version":1,"chat_id":5,"text":"Hi"}`)
+	wait(t, handling, "message hasn't been handled")
+
+	// The broker reconnects while the consumer still finishes the message of the lost channel,
+	// its subscription must not be cancelled on the new channel
+	server.conn(t, 0).drop()
+	second := server.conn(t, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Check(context.Background()) != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	current := b.channel().(*fakeChannel)
+	cancel()
+	for len(first.cancellations())+len(current.cancellations()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	wait(t, stopped, "Consume hasn't returned after cancellation")
+
+	if cancelled := first.cancellations(); len(cancelled) != 1 || cancelled[0] != tag {
+		t.Errorf("cancelled %v on the lost channel, want %s", cancelled, tag)
+	}
+	second.mu.Lock()
+	defer second.mu.Unlock()
+	for _, ch := range second.channels {
+		if cancelled := ch.cancellations(); len(cancelled) != 0 {
+			t.Errorf("consumers %v of the lost channel have been cancelled on the new one", cancelled)
+		}
+	}
+}
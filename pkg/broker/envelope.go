@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// NewCorrelationId returns a random identifier used to match a request with its replies
+func NewCorrelationId() string {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		// The system random source is broken, nothing can be done about it
+		panic(err)
+	}
+
+	return hex.EncodeToString(buf)
+}
+
+// runHandler calls the handler, a panic is returned as an error,
+// so a broken message is retried and dead-lettered instead of crashing the consumer
+func runHandler(handler Handler, msg UserMsg) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler has panicked: %v", r)
+		}
+	}()
+
+	return handler(msg)
+}
+
+// legacyCorrelationId returns the same correlation id for every delivery of the unversioned message,
+// so its redeliveries are recognized as the same request. The message id is unique within the chat,
+// the oldest producers didn't send it, the content is used then
+func legacyCorrelationId(chatId int64, messageId int, data []byte) string {
+	if messageId != 0 {
+		return "legacy-" + strconv.FormatInt(chatId, 10) + "-" + strconv.Itoa(messageId)
+	}
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:16])
+}
+
+// DecodeUserMsg parses the envelope, unversioned messages are upgraded
+// to the current version and messages of newer versions are rejected
+func DecodeUserMsg(data []byte) (UserMsg, error) {
+	var msg UserMsg
+
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return msg, err
+	}
+
+	switch {
+	case msg.Version == EnvelopeVersion:
+		return msg, nil
+	case msg.Version > EnvelopeVersion:
+		return msg, fmt.Errorf("unsupported envelope version %d", msg.Version)
+	}
+
+	var legacy legacyUserMsg
+	err = json.Unmarshal(data, &legacy)
+	if err != nil {
+		return msg, err
+	}
+
+	// The oldest producers didn't send the chat, the sender was used as the chat then
+	chatId := legacy.Chat.Id
+	if chatId == 0 {
+		chatId = legacy.From.Id
+	}
+
+	return UserMsg{
+		Version:       EnvelopeVersion,
+		CorrelationId: legacyCorrelationId(chatId, legacy.MessageId, data),
+		ChatId:        chatId,
+		ChatType:      legacy.Chat.Type,
+		UserId:        legacy.From.Id,
+		MessageId:     legacy.MessageId,
+		LanguageCode:  legacy.From.LanguageCode,
+		Data:          legacy.Data,
+		Location:      legacy.Location,
+		Venue:         legacy.Venue,
+		Command:       legacy.Command,
+	}, nil
+}
@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeUserMsg(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    UserMsg
+		wantErr bool
+	}{
+		{
+			name: "current",
+			data: `{"version":1,"correlation_id":"c1","chat_id":-100,"chat_type":"group","user_id":42,` +
+				`"message_id":7,"language_code":"en","text":"Hi","reply_to":"Response","reply_id":8,"tier":"pro"}`,
+			want: UserMsg{Version: 1, CorrelationId: "c1", ChatId: -100, ChatType: "group", UserId: 42,
+				MessageId: 7, LanguageCode: "en", Data: "Hi", ReplyTo: "Response", ReplyId: 8, Tier: "pro"},
+		},
+		{
+			name: "current with a partial answer",
+			data: `{"version":1,"correlation_id":"c1","chat_id":5,"text":"Big","partial":true,"seq":3}`,
+			want: UserMsg{Version: 1, CorrelationId: "c1", ChatId: 5, Data: "Big", Partial: true, Seq: 3},
+		},
+		{
+			name: "legacy group message",
+			data: `{"message_id":7,"text":"Hi","from":{"id":42,"language_code":"ru"},"chat":{"id":-100,"type":"group"}}`,
+			want: UserMsg{Version: EnvelopeVersion, CorrelationId: "legacy--100-7", ChatId: -100, ChatType: "group",
+				UserId: 42, MessageId: 7, LanguageCode: "ru", Data: "Hi"},
+		},
+		{
+			name: "legacy message without a chat",
+			data: `{"text":"Hi","from":{"id":42}}`,
+			want: UserMsg{Version: EnvelopeVersion, ChatId: 42, UserId: 42, Data: "Hi"},
+		},
+		{
+			name: "legacy location and command",
+			data: `{"from":{"id":42},"chat":{"id":42,"type":"private"},"location":{"latitude":51.5,"longitude":-0.12},` +
+				`"command":"reset"}`,
+			want: UserMsg{Version: EnvelopeVersion, ChatId: 42, ChatType: "private", UserId: 42,
+				Location: &Location{Latitude: 51.5, Longitude: -0.12}, Command: CmdReset},
+		},
+		{
+			name:    "newer version",
+			data:    `{"version":2,"chat_id":5,"text":"Hi"}`,
+			wantErr: true,
+		},
+		{
+			name:    "malformed json",
+			data:    `{"version":1,"text":`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong field type",
+			data:    `{"version":"one","text":"Hi"}`,
+			wantErr: true,
+		},
+		{
+			name:    "not an object",
+			data:    `"Hi"`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeUserMsg([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("DecodeUserMsg() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeUserMsg() error = %v", err)
+			}
+
+			// The upgraded messages without a message id get the correlation id from the content,
+			// every delivery of the message must get the same one
+			if tt.want.CorrelationId == "" {
+				again, _ := DecodeUserMsg([]byte(tt.data))
+				if len(got.CorrelationId) != 32 || again.CorrelationId != got.CorrelationId {
+					t.Errorf("CorrelationId = %q and %q, want the same one", got.CorrelationId, again.CorrelationId)
+				}
+				got.CorrelationId = ""
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeUserMsg() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package broker
+
+import (
+	"context"
+	"pocket_guide/pkg/config"
+	"sync"
+)
+
+// memoryQueueSize is the capacity of a MemoryBroker queue, Publish blocks when it is full.
+// The queue stands for the RabbitMQ queue, which is not limited by the worker and prefetch settings either:
+// the prefetch only bounds the messages taken by the workers of AmqpBroker, and the MemoryBroker workers
+// take one message each the same way. The capacity is fixed, it only keeps a stalled consumer
+// from taking all the memory, the publishers see a full queue as a publishing that has timed out
+const memoryQueueSize = 1024
+
+// NewBroker is a method that initializes the in-process queues,
+// only the number of retries is taken from the configuration
+func (m *MemoryBroker) NewBroker(cfg config.Broker) error {
+	m.queues = make(map[string]chan memoryMsg)
+	m.dead = make(map[string][][]byte)
+	m.maxRetries = cfg.MaxRetries
+	m.done = make(chan struct{})
+
+	return nil
+}
+
+// MakeQueue creates the queue if it doesn't exist yet
+func (m *MemoryBroker) MakeQueue(qname string) error {
+	m.queue(qname)
+
+	return nil
+}
+
+// Publish puts the message into the queue, waiting for free space until the context expires
+func (m *MemoryBroker) Publish(msg []byte, qname string, ctx context.Context) error {
+	return m.put(qname, memoryMsg{body: msg}, ctx)
+}
+
+// PublishRequest puts the message into the queue asking to answer into the replyTo queue
+func (m *MemoryBroker) PublishRequest(msg []byte, qname, replyTo, correlationId string, ctx context.Context) error {
+	return m.put(qname, memoryMsg{body: msg, replyTo: replyTo, correlationId: correlationId}, ctx)
+}
+
+// Consume runs the handler for the messages of the queue in a pool of workers,
+// the rest of the messages wait in the queue until one of the workers is free.
+// Failed messages are put back up to maxRetries times and then moved to the dead letters.
+// Consume returns when the context is cancelled or the broker is closed,
+// after the running handlers have finished
+func (m *MemoryBroker) Consume(qname string, workers int, handler Handler, ctx context.Context) error {
+	queue := m.queue(qname)
+	if workers < 1 {
+		workers = 1
+	}
+
+	var pool sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		pool.Add(1)
+		m.inflight.Add(1)
+		go func() {
+			defer m.inflight.Done()
+			defer pool.Done()
+			for !m.closed() {
+				select {
+				case msg := <-queue:
+					handlersInflight.WithLabelValues(qname).Inc()
+					m.handle(qname, msg, handler)
+					handlersInflight.WithLabelValues(qname).Dec()
+				case <-ctx.Done():
+					return
+				case <-m.done:
+					return
+				}
+			}
+		}()
+	}
+	pool.Wait()
+
+	return nil
+}
+
+// Check returns an error after the broker has been closed, the queues are always available before that
+func (m *MemoryBroker) Check(ctx context.Context) error {
+	if m.closed() {
+		return errClosed
+	}
+
+	return ctx.Err()
+}
+
+// DeadLetters returns the messages of the queue that couldn't be handled
+func (m *MemoryBroker) DeadLetters(qname string) [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dead := make([][]byte, len(m.dead[qname]))
+	copy(dead, m.dead[qname])
+
+	return dead
+}
+
+// Close stops all consumers, it is safe to call it several times,
+// since one MemoryBroker is usually shared by the bot and the AI service
+func (m *MemoryBroker) Close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+}
+
+// handle decodes the message, runs the handler and retries or dead-letters the failed message
+func (m *MemoryBroker) handle(qname string, msg memoryMsg, handler Handler) {
+	userMsg, err := DecodeUserMsg(msg.body)
+	if err == nil {
+		if userMsg.ReplyTo == "" {
+			userMsg.ReplyTo = msg.replyTo
+		}
+		if msg.correlationId != "" {
+			userMsg.CorrelationId = msg.correlationId
+		}
+
+		err = runHandler(handler, userMsg)
+		if err == nil {
+			messagesConsumed.WithLabelValues(qname, "ack").Inc()
+			return
+		}
+
+		// Workers must not wait for their own queue, a retry that doesn't fit is dead-lettered
+		if msg.retries < m.maxRetries {
+			msg.retries++
+			select {
+			case m.queue(qname) <- msg:
+				messagesConsumed.WithLabelValues(qname, "retry").Inc()
+				return
+			default:
+			}
+		}
+	}
+
+	messagesConsumed.WithLabelValues(qname, "dead").Inc()
+	m.mu.Lock()
+	m.dead[qname] = append(m.dead[qname], msg.body)
+	m.mu.Unlock()
+}
+
+// closed reports whether the broker has been closed. The selects pick a random ready case,
+// so it is checked first to stop taking and accepting messages right after Close
+func (m *MemoryBroker) closed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// put adds the message to the queue
+func (m *MemoryBroker) put(qname string, msg memoryMsg, ctx context.Context) error {
+	var err error
+	if m.closed() {
+		err = errClosed
+		published(qname, err)
+		return err
+	}
+
+	select {
+	case m.queue(qname) <- msg:
+	case <-m.done:
+		err = errClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	published(qname, err)
+
+	return err
+}
+
+// queue returns the channel of the queue, creating it on the first use
+func (m *MemoryBroker) queue(qname string) chan memoryMsg {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	queue, ok := m.queues[qname]
+	if !ok {
+		queue = make(chan memoryMsg, memoryQueueSize)
+		m.queues[qname] = queue
+	}
+
+	return queue
+}
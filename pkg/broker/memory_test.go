@@ -0,0 +1,248 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"pocket_guide/pkg/config"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newMemoryBroker returns the broker closed at the end of the test
+func newMemoryBroker(t *testing.T, maxRetries int) *MemoryBroker {
+	var m MemoryBroker
+	if err := m.NewBroker(config.Broker{MaxRetries: maxRetries}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+
+	return &m
+}
+
+// consume runs Consume in the background, the returned channel is closed when it returns
+func consume(m *MemoryBroker, qname string, handler Handler, ctx context.Context) <-chan struct{} {
+	stopped := make(chan struct{})
+	go func() {
+		_ = m.Consume(qname, 2, handler, ctx)
+		close(stopped)
+	}()
+
+	return stopped
+}
+
+// wait fails the test if the channel isn't closed in time
+func wait(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal(what)
+	}
+}
+
+func TestMemoryBrokerPublishConsume(t *testing.T) {
+	m := newMemoryBroker(t, 3)
+	if err := m.MakeQueue("aiRequest"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan UserMsg, 2)
+	consume(m, "aiRequest", func(msg UserMsg) error {
+		got <- msg
+		return nil
+	}, context.Background())
+
+	ctx := context.Background()
+	if err := m.Publish([]byte(`{"version":1,"chat_id":5,"text":"Hi"}`), "aiRequest", ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.PublishRequest([]byte(`{"version":1,"chat_id":5,"text":"Where?"}`),
+		"aiRequest", "Response", "c1", ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	texts := map[string]UserMsg{}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-got:
+			texts[msg.Data] = msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("the messages have not been consumed")
+		}
+	}
+	if msg, ok := texts["Hi"]; !ok || msg.ChatId != 5 {
+		t.Errorf("message Hi = %+v", msg)
+	}
+	if msg := texts["Where?"]; msg.ReplyTo != "Response" || msg.CorrelationId != "c1" {
+		t.Errorf("request = %+v, want reply_to Response and correlation id c1", msg)
+	}
+	if dead := m.DeadLetters("aiRequest"); len(dead) != 0 {
+		t.Errorf("dead letters %q, want none", dead)
+	}
+}
+
+func TestMemoryBrokerRetries(t *testing.T) {
+	m := newMemoryBroker(t, 2)
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+	done := make(chan struct{})
+	consume(m, "aiRequest", func(msg UserMsg) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[msg.Data]++
+		switch {
+		case msg.Data == "flaky" && calls[msg.Data] == 2:
+			close(done)
+			return nil
+		case msg.Data == "broken" && calls[msg.Data] == 3:
+			defer close(done)
+		}
+		return errors.New("failed")
+	}, context.Background())
+
+	ctx := context.Background()
+	_ = m.Publish([]byte(`{"version":1,"text":"flaky"}`), "aiRequest", ctx)
+	wait(t, done, "the failed message has not been redelivered")
+
+	done = make(chan struct{})
+	_ = m.Publish([]byte(`{"version":1,"text":"broken"}`), "aiRequest", ctx)
+	wait(t, done, "the failed message has not been redelivered maxRetries times")
+
+	// The dead letter is added after the handler returns
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.DeadLetters("aiRequest")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["flaky"] != 2 {
+		t.Errorf("flaky message handled %d times, want 2", calls["flaky"])
+	}
+	if calls["broken"] != 3 {
+		t.Errorf("broken message handled %d times, want 1 + maxRetries = 3", calls["broken"])
+	}
+	dead := m.DeadLetters("aiRequest")
+	if len(dead) != 1 || string(dead[0]) != `{"version":1,"text":"broken"}` {
+		t.Errorf("dead letters %q, want only the broken message", dead)
+	}
+}
+
+func TestMemoryBrokerDeadLettersMalformed(t *testing.T) {
+	m := newMemoryBroker(t, 3)
+
+	handled := make(chan struct{}, 1)
+	consume(m, "aiRequest", func(msg UserMsg) error {
+		handled <- struct{}{}
+		return nil
+	}, context.Background())
+
+	_ = m.Publish([]byte(`not json`), "aiRequest", context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.DeadLetters("aiRequest")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if dead := m.DeadLetters("aiRequest"); len(dead) != 1 || string(dead[0]) != "not json" {
+		t.Errorf("dead letters %q, want the malformed message", dead)
+	}
+	if len(handled) != 0 {
+		t.Error("the malformed message has reached the handler")
+	}
+}
+
+func TestMemoryBrokerCountsMessages(t *testing.T) {
+	m := newMemoryBroker(t, 3)
+	published := testutil.ToFloat64(messagesPublished.WithLabelValues("metricsTest", "ok"))
+	dead := testutil.ToFloat64(messagesConsumed.WithLabelValues("metricsTest", "dead"))
+
+	consume(m, "metricsTest", func(msg UserMsg) error { return nil }, context.Background())
+	if err := m.Publish([]byte(`not json`), "metricsTest", context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.DeadLetters("metricsTest")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := testutil.ToFloat64(messagesPublished.WithLabelValues("metricsTest", "ok")); got != published+1 {
+		t.Errorf("published = %v, want %v", got, published+1)
+	}
+	if got := testutil.ToFloat64(messagesConsumed.WithLabelValues("metricsTest", "dead")); got != dead+1 {
+		t.Errorf("dead = %v, want %v", got, dead+1)
+	}
+}
+
+func TestMemoryBrokerCloseDrains(t *testing.T) {
+	m := newMemoryBroker(t, 3)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	stopped := consume(m, "aiRequest", func(msg UserMsg) error {
+		close(started)
+		<-release
+		close(finished)
+		return nil
+	}, context.Background())
+
+	_ = m.Publish([]byte(`{"version":1,"text":"Hi"}`), "aiRequest", context.Background())
+	wait(t, started, "the message has not been consumed")
+
+	m.Close()
+	m.Close()
+	if err := m.Publish([]byte(`{"version":1,"text":"late"}`), "aiRequest", context.Background()); err == nil {
+		t.Error("Publish() has succeeded after Close()")
+	}
+	if err := m.Check(context.Background()); err == nil {
+		t.Error("Check() has succeeded after Close()")
+	}
+
+	select {
+	case <-stopped:
+		t.Fatal("Consume() has returned before the running handler has finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	wait(t, stopped, "Consume() has not returned after Close()")
+	select {
+	case <-finished:
+	default:
+		t.Error("the running handler has been abandoned")
+	}
+	if dead := m.DeadLetters("aiRequest"); len(dead) != 0 {
+		t.Errorf("dead letters %q, want none", dead)
+	}
+}
+
+func TestMemoryBrokerRecoversPanic(t *testing.T) {
+	m := newMemoryBroker(t, 1)
+
+	var mu sync.Mutex
+	calls := 0
+	consume(m, "aiRequest", func(msg UserMsg) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		panic("broken message")
+	}, context.Background())
+
+	_ = m.Publish([]byte(`{"version":1,"text":"poison"}`), "aiRequest", context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.DeadLetters("aiRequest")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if dead := m.DeadLetters("aiRequest"); len(dead) != 1 {
+		t.Fatalf("dead letters %q, want the poison message", dead)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Errorf("handled %d times, want 1 + maxRetries = 2", calls)
+	}
+}
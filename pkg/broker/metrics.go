@@ -0,0 +1,31 @@
+package broker
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The broker metrics are shared by AmqpBroker and MemoryBroker
+var (
+	messagesPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "guide_broker_messages_published_total",
+		Help: "Messages published to the queue, result is 'ok' or 'error'.",
+	}, []string{"queue", "result"})
+	messagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "guide_broker_messages_consumed_total",
+		Help: "Messages taken from the queue, result is 'ack', 'retry' or 'dead'.",
+	}, []string{"queue", "result"})
+	handlersInflight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "guide_broker_handlers_inflight",
+		Help: "Messages of the queue being handled right now.",
+	}, []string{"queue"})
+)
+
+// published counts the result of a publishing
+func published(qname string, err error) {
+	if err != nil {
+		messagesPublished.WithLabelValues(qname, "error").Inc()
+		return
+	}
+	messagesPublished.WithLabelValues(qname, "ok").Inc()
+}
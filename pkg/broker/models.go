@@ -1,25 +1,185 @@
 package broker
 
 import (
+	"context"
 	amqp "github.com/rabbitmq/amqp091-go"
-	"os"
+	"pocket_guide/pkg/config"
 	"pocket_guide/pkg/logging"
+	"sync"
 )
 
 // Ivan Orshak, 13.07.2023
 
-type Broker struct {
-	ch     *amqp.Channel
-	conn   *amqp.Connection
-	queues map[string]amqp.Queue
-	log    logging.Log
-	cfgF   *os.File
-	err    error
+// Publisher sends messages to the queues
+type Publisher interface {
+	MakeQueue(qname string) error
+	Publish(msg []byte, qname string, ctx context.Context) error
+	PublishRequest(msg []byte, qname, replyTo, correlationId string, ctx context.Context) error
+	Check(ctx context.Context) error
+	Close()
 }
 
+// Consumer receives messages from the queues and passes them to the handler,
+// workers is the number of messages handled at the same time
+type Consumer interface {
+	MakeQueue(qname string) error
+	Consume(qname string, workers int, handler Handler, ctx context.Context) error
+	Check(ctx context.Context) error
+	Close()
+}
+
+// Broker is a message transport able to both publish and consume
+type Broker interface {
+	Publisher
+	Consumer
+}
+
+// AmqpBroker is the Broker working over RabbitMQ
+type AmqpBroker struct {
+	// mu guards the connection, the channel and the queues, which are replaced on reconnection
+	mu   sync.RWMutex
+	ch   amqpChannel
+	conn amqpConn
+	cfg  config.Broker
+	// dial opens the connection with the broker, it is replaced in tests
+	dial   func(url string) (amqpConn, error)
+	queues map[string]struct{}
+	ready  chan struct{}
+	// lost is closed by watch() when the current channel is lost, a new one comes with every channel
+	lost     chan struct{}
+	done     chan struct{}
+	inflight sync.WaitGroup
+	log      logging.Log
+	err      error
+}
+
+// amqpConn is the part of the RabbitMQ connection used by AmqpBroker
+type amqpConn interface {
+	Channel() (amqpChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+	Close() error
+}
+
+// amqpChannel is the part of the RabbitMQ channel used by AmqpBroker
+type amqpChannel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+	Close() error
+}
+
+// Handler processes a message received from the broker,
+// the message is acknowledged only if the handler returns nil
+type Handler func(msg UserMsg) error
+
+// EnvelopeVersion is the current version of the UserMsg format,
+// consumers upgrade older messages and drop newer ones they can't read
+const EnvelopeVersion = 1
+
+// UserMsg is the envelope exchanged between the bot and the AI service
 type UserMsg struct {
-	Data   string `json:"text"`
-	ChatId struct {
-		Id int64 `json:"id"`
+	Version       int    `json:"version"`
+	CorrelationId string `json:"correlation_id"`
+	ChatId        int64  `json:"chat_id"`
+	ChatType      string `json:"chat_type,omitempty"`
+	UserId        int64  `json:"user_id"`
+	MessageId     int    `json:"message_id,omitempty"`
+	// LanguageCode is the IETF tag of the user language as telegram sends it or as chosen with /language,
+	// it is matched to the catalog only for the system texts
+	LanguageCode string `json:"language_code,omitempty"`
+	Data         string `json:"text"`
+	// ReplyTo is the queue the answer is published to, empty means the default one
+	ReplyTo string `json:"reply_to,omitempty"`
+	// ReplyId is the placeholder message the bot edits into the answer
+	ReplyId int `json:"reply_id,omitempty"`
+	// Partial answers carry the text generated so far, Seq orders them within one answer
+	Partial bool `json:"partial,omitempty"`
+	Seq     int  `json:"seq,omitempty"`
+
+	Location *Location `json:"location,omitempty"`
+	Venue    *Venue    `json:"venue,omitempty"`
+	// Voice is a voice message to be transcribed into the question
+	Voice *Voice `json:"voice,omitempty"`
+	// Photo is a photo to be described, the caption is the question
+	Photo *Photo `json:"photo,omitempty"`
+	// Command is a service instruction for the AI service, e.g. CmdReset
+	Command string `json:"command,omitempty"`
+	// Tier is the limits tier of the user resolved by the bot, empty means the default one
+	Tier string `json:"tier,omitempty"`
+}
+
+// legacyUserMsg is the unversioned format, a raw telegram message
+type legacyUserMsg struct {
+	MessageId int    `json:"message_id"`
+	Data      string `json:"text"`
+	From      struct {
+		Id           int64  `json:"id"`
+		LanguageCode string `json:"language_code,omitempty"`
 	} `json:"from"`
+	Chat struct {
+		Id   int64  `json:"id"`
+		Type string `json:"type"`
+	} `json:"chat"`
+	Location *Location `json:"location,omitempty"`
+	Venue    *Venue    `json:"venue,omitempty"`
+	Command  string    `json:"command,omitempty"`
+}
+
+// Location is a point on the map shared by the user
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Venue is a named place shared by the user
+type Venue struct {
+	Location Location `json:"location"`
+	Title    string   `json:"title"`
+	Address  string   `json:"address"`
+}
+
+// Voice is a reference to the telegram file of a voice message, the AI service downloads it by FileId.
+// The files are never put into the envelope, the messages are kept by the broker and redelivered
+type Voice struct {
+	FileId   string `json:"file_id"`
+	MimeType string `json:"mime_type,omitempty"`
+	Duration int    `json:"duration,omitempty"`
+}
+
+// Photo is a reference to the telegram file of a photo, the AI service downloads it by FileId
+type Photo struct {
+	FileId   string `json:"file_id"`
+	UniqueId string `json:"file_unique_id,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Size     int    `json:"file_size,omitempty"`
+}
+
+// CmdReset asks the AI service to forget the conversation of the chat
+const CmdReset = "reset"
+
+// MemoryBroker is the in-process Broker built on channels,
+// it lets both services run in one binary and be tested without RabbitMQ
+type MemoryBroker struct {
+	mu         sync.Mutex
+	queues     map[string]chan memoryMsg
+	dead       map[string][][]byte
+	maxRetries int
+	done       chan struct{}
+	closeOnce  sync.Once
+	inflight   sync.WaitGroup
+}
+
+// memoryMsg is a message in the MemoryBroker queue with its redelivery counter
+type memoryMsg struct {
+	body          []byte
+	replyTo       string
+	correlationId string
+	retries       int
 }
@@ -0,0 +1,182 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+// minReconnectDelay and maxReconnectDelay bound the pause between reconnection attempts
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// Errors of the broker state
+var (
+	// errClosed is returned while waiting for a broker that has been closed
+	errClosed       = errors.New("broker has been closed")
+	errReconnecting = errors.New("connection with the broker is being restored")
+	// errRedelivered is the failure of a message whose consumer has stopped before settling it
+	errRedelivered = errors.New("message has been redelivered, its previous consumer has stopped while handling it")
+)
+
+// watch waits for the connection or the channel to be closed by the server
+// and restores them with the queues declared before
+func (b *AmqpBroker) watch() {
+	// The connection is watched once, it outlives the channels reopened on it
+	var watched amqpConn
+	var connClosed chan *amqp.Error
+
+	for {
+		b.mu.RLock()
+		if b.conn != watched {
+			watched = b.conn
+			connClosed = b.conn.NotifyClose(make(chan *amqp.Error, 1))
+		}
+		chClosed := b.ch.NotifyClose(make(chan *amqp.Error, 1))
+		b.mu.RUnlock()
+
+		var reason *amqp.Error
+		select {
+		case reason = <-connClosed:
+			watched = nil
+		case reason = <-chClosed:
+		case <-b.done:
+			return
+		}
+
+		// Close() has been called, nothing to restore
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+
+		b.log.Error("watch(): Connection with the broker has been lost", "err", reason)
+		// The consumers wait for the new ready after they have seen lost
+		b.mu.Lock()
+		b.ready = make(chan struct{})
+		close(b.lost)
+		b.mu.Unlock()
+
+		if !b.reconnect() {
+			return
+		}
+
+		b.mu.RLock()
+		close(b.ready)
+		b.mu.RUnlock()
+		b.log.Info("watch(): Connection with the broker has been restored")
+	}
+}
+
+// reconnect tries to restore the channel with growing delays until it succeeds
+// or the broker is closed, the queues are declared on the new channel
+func (b *AmqpBroker) reconnect() bool {
+	delay := minReconnectDelay
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-b.done:
+			return false
+		}
+
+		b.log.Info("reconnect(): Reconnecting to the broker", "attempt", attempt)
+		err := b.reopen()
+		if err == nil {
+			err = b.redeclare()
+			if err == nil {
+				return true
+			}
+			b.log.Error("reconnect(): Unable to declare queues", "err", err)
+			// watch() doesn't see this channel, so its consumers are told here
+			b.mu.Lock()
+			conn := b.conn
+			close(b.lost)
+			b.mu.Unlock()
+			conn.Close()
+		}
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// redeclare declares all the queues of the broker again
+func (b *AmqpBroker) redeclare() error {
+	b.mu.RLock()
+	queues := make([]string, 0, len(b.queues))
+	for qname := range b.queues {
+		queues = append(queues, qname)
+	}
+	b.mu.RUnlock()
+
+	for _, qname := range queues {
+		err := b.declare(qname)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lostCh returns the channel closed when the current broker channel is lost
+func (b *AmqpBroker) lostCh() <-chan struct{} {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.lost
+}
+
+// channel returns the current channel with the broker
+func (b *AmqpBroker) channel() amqpChannel {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.ch
+}
+
+// waitReady blocks until the broker is connected, the context expires or the broker is closed
+func (b *AmqpBroker) waitReady(ctx context.Context) error {
+	b.mu.RLock()
+	ready := b.ready
+	b.mu.RUnlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-b.done:
+		return errClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Check reports the state of the connection without talking to the server:
+// nil if the connection and the channel are open, an error while reconnecting or after Close()
+func (b *AmqpBroker) Check(ctx context.Context) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	select {
+	case <-b.done:
+		return errClosed
+	default:
+	}
+	select {
+	case <-b.ready:
+	default:
+		return errReconnecting
+	}
+	if b.conn == nil || b.conn.IsClosed() || b.ch == nil || b.ch.IsClosed() {
+		return errReconnecting
+	}
+
+	return ctx.Err()
+}
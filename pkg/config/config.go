@@ -0,0 +1,323 @@
+package config
+
+import (
+	"errors"
+	"github.com/joho/godotenv"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration files in the order they are applied, both are optional
+const (
+	cfgFile = "cfg/.cfg"
+	envFile = "cfg/.env"
+)
+
+// replyMargin is added to AI_TIMEOUT_SEC in the default BOT_REPLY_TIMEOUT_SEC for the broker delays
+// and the reconnections
+const replyMargin = 30 * time.Second
+
+// shutdownMargin is added to AI_TIMEOUT_SEC in the default SHUTDOWN_TIMEOUT_SEC,
+// so a request that has just been sent to the AI still gets its answer published
+const shutdownMargin = 30 * time.Second
+
+// defaultLimitsFile is used if LIMITS_FILE is not set, the built-in limits apply if it doesn't exist
+const defaultLimitsFile = "cfg/limits.json"
+
+// secretPattern is the set of characters telegram allows in the webhook secret token
+var secretPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+// Load reads the configuration: the defaults are overridden by cfg/.cfg,
+// then by cfg/.env and then by the environment variables.
+// The values required by the parts the command runs are checked once all values have been parsed,
+// the problems are reported together
+func (c *Config) Load(parts Part) error {
+	return c.LoadFiles(parts, cfgFile, envFile)
+}
+
+// LoadFiles is Load with the configuration files given explicitly, the missing files are skipped
+func (c *Config) LoadFiles(parts Part, files ...string) error {
+	src := source{values: make(map[string]string)}
+
+	for _, file := range files {
+		values, err := godotenv.Read(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return errors.New("config: " + file + ": " + err.Error())
+		}
+		for key, value := range values {
+			src.values[key] = value
+		}
+	}
+	for _, pair := range os.Environ() {
+		key, value, _ := strings.Cut(pair, "=")
+		src.values[key] = value
+	}
+
+	c.parse(&src)
+	if len(src.errs) == 0 {
+		c.validate(&src, parts)
+	}
+	if len(src.errs) != 0 {
+		return errors.New("config: " + strings.Join(src.errs, "; "))
+	}
+
+	return nil
+}
+
+// Enabled reports whether the database is configured
+func (d Db) Enabled() bool {
+	return d.Host != ""
+}
+
+// Webhook reports whether telegram updates are received through the webhook
+func (b Bot) Webhook() bool {
+	return b.Mode == "webhook"
+}
+
+// parse fills the configuration from the raw values, every value has a default
+func (c *Config) parse(src *source) {
+	c.Broker = Broker{
+		Url:               src.str("BROKER_URL", ""),
+		MaxRetries:        src.integer("BROKER_MAX_RETRIES", 3),
+		ConsumerExclusive: src.boolean("BROKER_CONSUMER_EXCLUSIVE", false),
+		ConsumerNoLocal:   src.boolean("BROKER_CONSUMER_NO_LOCAL", false),
+		ConsumerNoWait:    src.boolean("BROKER_CONSUMER_NO_WAIT", false),
+	}
+
+	c.Bot = Bot{
+		Token:             src.str("BOT_TOKEN", ""),
+		ReplyTimeout:      src.seconds("BOT_REPLY_TIMEOUT_SEC", 0),
+		Mode:              src.str("BOT_MODE", "polling"),
+		WebhookUrl:        src.str("BOT_WEBHOOK_URL", ""),
+		WebhookListen:     src.str("BOT_WEBHOOK_LISTEN", ":8443"),
+		WebhookSecret:     src.str("BOT_WEBHOOK_SECRET", ""),
+		WebhookCert:       src.str("BOT_WEBHOOK_CERT", ""),
+		WebhookKey:        src.str("BOT_WEBHOOK_KEY", ""),
+		WebhookUploadCert: src.boolean("BOT_WEBHOOK_UPLOAD_CERT", false),
+		UpdateWorkers:     src.integer("BOT_UPDATE_WORKERS", 16),
+		SenderWorkers:     src.integer("BOT_SENDER_WORKERS", 16),
+		QueueDepth:        src.integer("BOT_QUEUE_DEPTH", 100),
+		VoiceMaxDuration:  src.seconds("BOT_VOICE_MAX_SEC", 120),
+		MetricsListen:     src.str("BOT_METRICS_LISTEN", ":9090"),
+	}
+
+	c.Ai = Ai{
+		Token:           src.str("GPT_TOKEN", ""),
+		Provider:        src.str("AI_PROVIDER", "openai"),
+		BaseURL:         src.str("AI_BASE_URL", ""),
+		MockScript:      src.str("AI_MOCK_SCRIPT", ""),
+		Model:           src.str("AI_MODEL", "gpt-3.5-turbo"),
+		Temperature:     float32(src.float("AI_TEMPERATURE", 0)),
+		MaxTokens:       src.integer("AI_MAX_TOKENS", 0),
+		HistoryTokens:   src.integer("AI_HISTORY_TOKENS", 2000),
+		PromptFile:      src.str("AI_PROMPT_FILE", "cfg/prompt.tmpl"),
+		City:            src.str("AI_CITY", ""),
+		StreamInterval:  time.Duration(src.integer("AI_STREAM_INTERVAL_MS", 1000)) * time.Millisecond,
+		Timeout:         src.seconds("AI_TIMEOUT_SEC", 120),
+		Workers:         src.integer("AI_WORKERS", 8),
+		MaxRetries:      src.integer("AI_MAX_RETRIES", 3),
+		Transcriber:     src.str("AI_TRANSCRIBER", ""),
+		TranscribeURL:   src.str("AI_TRANSCRIBE_URL", ""),
+		TranscribeModel: src.str("AI_TRANSCRIBE_MODEL", "whisper-1"),
+		StubTranscript:  src.str("AI_STUB_TRANSCRIPT", ""),
+		VisionModel:     src.str("AI_VISION_MODEL", "gpt-4o-mini"),
+		MetricsListen:   src.str("AI_METRICS_LISTEN", ":9091"),
+	}
+
+	// The user waits for one attempt of the AI service, the answers of the redeliveries coming later are dropped
+	if c.Bot.ReplyTimeout == 0 {
+		c.Bot.ReplyTimeout = c.Ai.Timeout + replyMargin
+	}
+
+	c.Db = Db{
+		Host:            src.str("DB_HOST", ""),
+		Port:            src.str("DB_PORT", "5432"),
+		User:            src.str("DB_USER", ""),
+		Password:        src.str("DB_PASSWORD", ""),
+		Name:            src.str("DB_NAME", ""),
+		SslMode:         src.str("DB_SSLMODE", "disable"),
+		MaxOpenConns:    src.integer("DB_MAX_OPEN_CONNS", 10),
+		MaxIdleConns:    src.integer("DB_MAX_IDLE_CONNS", 5),
+		ConnMaxLifetime: src.seconds("DB_CONN_MAX_LIFETIME", 1800),
+	}
+
+	c.Log = Log{
+		Format:     src.str("LOG_FORMAT", "logfmt"),
+		Level:      src.str("LOG_LEVEL", "info"),
+		Stdout:     src.boolean("LOG_STDOUT", false),
+		MaxSizeMb:  src.integer("LOG_MAX_SIZE_MB", 100),
+		MaxAgeDays: src.integer("LOG_MAX_AGE_DAYS", 7),
+	}
+
+	c.Health = Health{
+		Timeout: time.Duration(src.integer("HEALTH_TIMEOUT_MS", 3000)) * time.Millisecond,
+	}
+
+	c.LimitsFile = src.str("LIMITS_FILE", defaultLimitsFile)
+
+	c.ShutdownTimeout = src.seconds("SHUTDOWN_TIMEOUT_SEC", 0)
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = c.Ai.Timeout + shutdownMargin
+	}
+}
+
+// validate checks the required values of the parts and the values that depend on each other
+func (c *Config) validate(src *source, parts Part) {
+	if parts&PartAmqp != 0 {
+		src.require("BROKER_URL", c.Broker.Url)
+		src.check(c.Broker.MaxRetries >= 0, "BROKER_MAX_RETRIES must not be negative")
+	}
+
+	if parts&PartBot != 0 {
+		src.require("BOT_TOKEN", c.Bot.Token)
+		src.check(c.Bot.ReplyTimeout >= c.Ai.Timeout,
+			"BOT_REPLY_TIMEOUT_SEC must be at least AI_TIMEOUT_SEC = "+strconv.Itoa(int(c.Ai.Timeout/time.Second))+
+				", otherwise the users are told that a request has failed while it may still be answered")
+		src.check(c.Bot.UpdateWorkers >= 1, "BOT_UPDATE_WORKERS must be at least 1")
+		src.check(c.Bot.SenderWorkers >= 1, "BOT_SENDER_WORKERS must be at least 1")
+		src.check(c.Bot.QueueDepth >= 1, "BOT_QUEUE_DEPTH must be at least 1")
+		src.check(c.Bot.VoiceMaxDuration >= 0, "BOT_VOICE_MAX_SEC must not be negative")
+
+		switch c.Bot.Mode {
+		case "", "polling":
+		case "webhook":
+			src.require("BOT_WEBHOOK_URL", c.Bot.WebhookUrl)
+			src.check(secretPattern.MatchString(c.Bot.WebhookSecret),
+				"BOT_WEBHOOK_SECRET is required in webhook mode, allowed characters: A-Z, a-z, 0-9, _ and -")
+			src.check((c.Bot.WebhookCert == "") == (c.Bot.WebhookKey == ""),
+				"BOT_WEBHOOK_CERT and BOT_WEBHOOK_KEY must be set together")
+			src.check(!c.Bot.WebhookUploadCert || c.Bot.WebhookCert != "",
+				"BOT_WEBHOOK_UPLOAD_CERT requires BOT_WEBHOOK_CERT")
+		default:
+			src.fail("BOT_MODE must be 'polling' or 'webhook', got: " + c.Bot.Mode)
+		}
+	}
+
+	if parts&PartAi != 0 {
+		// The broker carries only the file ids of the photos and the voice messages,
+		// the AI service downloads them from telegram with the token of the bot
+		if parts&PartBot == 0 {
+			src.require("BOT_TOKEN", c.Bot.Token)
+		}
+		switch c.Ai.Provider {
+		case "openai":
+			// Self-hosted endpoints may work without a key
+			if c.Ai.BaseURL == "" {
+				src.require("GPT_TOKEN", c.Ai.Token)
+			}
+		case "mock":
+		default:
+			src.fail("AI_PROVIDER must be 'openai' or 'mock', got: " + c.Ai.Provider)
+		}
+		src.check(c.Ai.Timeout > 0, "AI_TIMEOUT_SEC must be positive")
+		src.check(c.Ai.Workers >= 1, "AI_WORKERS must be at least 1")
+		src.check(c.Ai.MaxRetries >= 0, "AI_MAX_RETRIES must not be negative")
+		switch c.Ai.Transcriber {
+		case "", "whisper", "stub":
+		default:
+			src.fail("AI_TRANSCRIBER must be 'whisper' or 'stub', got: " + c.Ai.Transcriber)
+		}
+	}
+
+	if c.Db.Enabled() {
+		src.check(c.Db.User != "" && c.Db.Name != "", "DB_USER and DB_NAME are required when DB_HOST is set")
+	}
+
+	src.check(c.Log.Format == "logfmt" || c.Log.Format == "json", "LOG_FORMAT must be 'logfmt' or 'json'")
+	src.check(c.Log.Level == "debug" || c.Log.Level == "info" || c.Log.Level == "error",
+		"LOG_LEVEL must be 'debug', 'info' or 'error'")
+	src.check(c.Log.MaxSizeMb >= 0 && c.Log.MaxAgeDays >= 0, "LOG_MAX_SIZE_MB and LOG_MAX_AGE_DAYS must not be negative")
+
+	src.check(c.Health.Timeout > 0, "HEALTH_TIMEOUT_MS must be positive")
+	src.check(c.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT_SEC must be positive")
+
+	// A missing default file means the built-in limits, a missing configured one is a mistake
+	if c.LimitsFile != defaultLimitsFile {
+		_, err := os.Stat(c.LimitsFile)
+		src.check(err == nil, "LIMITS_FILE: file "+c.LimitsFile+" is not available")
+	}
+}
+
+// str returns the value of the key or def if it is not set
+func (s *source) str(key, def string) string {
+	value, ok := s.values[key]
+	if !ok {
+		return def
+	}
+
+	return value
+}
+
+// integer returns the integer value of the key or def if it is not set
+func (s *source) integer(key string, def int) int {
+	value, ok := s.values[key]
+	if !ok {
+		return def
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		s.fail(key + ": '" + value + "' is not an integer")
+	}
+
+	return n
+}
+
+// float returns the float value of the key or def if it is not set
+func (s *source) float(key string, def float64) float64 {
+	value, ok := s.values[key]
+	if !ok {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 32)
+	if err != nil {
+		s.fail(key + ": '" + value + "' is not a number")
+	}
+
+	return f
+}
+
+// boolean returns the bool value of the key or def if it is not set
+func (s *source) boolean(key string, def bool) bool {
+	value, ok := s.values[key]
+	if !ok {
+		return def
+	}
+
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		s.fail(key + ": '" + value + "' is not a boolean")
+	}
+
+	return b
+}
+
+// seconds returns the duration of the key given in seconds or def seconds if it is not set
+func (s *source) seconds(key string, def int) time.Duration {
+	return time.Duration(s.integer(key, def)) * time.Second
+}
+
+// require reports the missing required value
+func (s *source) require(key, value string) {
+	if value == "" {
+		s.fail(key + " is required")
+	}
+}
+
+// check reports the problem if the condition is false
+func (s *source) check(ok bool, problem string) {
+	if !ok {
+		s.fail(problem)
+	}
+}
+
+// fail remembers the problem, they are reported together
+func (s *source) fail(problem string) {
+	s.errs = append(s.errs, problem)
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unsetenv removes the variable for the test, it is restored afterwards
+func unsetenv(t *testing.T, key string) {
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
+
+// writeFile writes the configuration file to the temporary directory and returns its name
+func writeFile(t *testing.T, dir, name, data string) string {
+	fileName := filepath.Join(dir, name)
+	if err := os.WriteFile(fileName, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return fileName
+}
+
+func TestReplyTimeoutDefault(t *testing.T) {
+	t.Setenv("BOT_TOKEN", "token")
+	t.Setenv("AI_TIMEOUT_SEC", "100")
+	t.Setenv("BROKER_MAX_RETRIES", "2")
+
+	var c Config
+	if err := c.LoadFiles(PartBot); err != nil {
+		t.Fatal(err)
+	}
+	// The redeliveries of the request are not waited for
+	if want := 100*time.Second + replyMargin; c.Bot.ReplyTimeout != want {
+		t.Fatalf("reply timeout %v, want %v", c.Bot.ReplyTimeout, want)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		shutdown string
+		want     time.Duration
+	}{
+		{name: "default", want: 100*time.Second + shutdownMargin},
+		{name: "configured", shutdown: "20", want: 20 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("BOT_TOKEN", "token")
+			t.Setenv("GPT_TOKEN", "token")
+			t.Setenv("AI_TIMEOUT_SEC", "100")
+			if test.shutdown != "" {
+				t.Setenv("SHUTDOWN_TIMEOUT_SEC", test.shutdown)
+			} else {
+				unsetenv(t, "SHUTDOWN_TIMEOUT_SEC")
+			}
+
+			var c Config
+			if err := c.LoadFiles(PartAi); err != nil {
+				t.Fatal(err)
+			}
+			if c.ShutdownTimeout != test.want {
+				t.Fatalf("shutdown timeout %v, want %v", c.ShutdownTimeout, test.want)
+			}
+		})
+	}
+}
+
+func TestReplyTimeoutTooShort(t *testing.T) {
+	t.Setenv("BOT_TOKEN", "token")
+	t.Setenv("AI_TIMEOUT_SEC", "100")
+	t.Setenv("BROKER_MAX_RETRIES", "2")
+	t.Setenv("BOT_REPLY_TIMEOUT_SEC", "50")
+
+	var c Config
+	err := c.LoadFiles(PartBot)
+	if err == nil || !strings.Contains(err.Error(), "BOT_REPLY_TIMEOUT_SEC") {
+		t.Fatalf("error %v, want the BOT_REPLY_TIMEOUT_SEC check", err)
+	}
+
+	t.Setenv("BOT_REPLY_TIMEOUT_SEC", "100")
+	if err := c.LoadFiles(PartBot); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequiredValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts Part
+		key   string
+	}{
+		{"bot token", PartBot | PartAi, "BOT_TOKEN"},
+		{"gpt token", PartAi, "GPT_TOKEN"},
+		{"broker url", PartAmqp, "BROKER_URL"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("BOT_TOKEN", "token")
+			t.Setenv("GPT_TOKEN", "token")
+			t.Setenv("BROKER_URL", "amqp://localhost")
+			t.Setenv("AI_PROVIDER", "openai")
+			unsetenv(t, "AI_BASE_URL")
+			t.Setenv(test.key, "")
+
+			var c Config
+			err := c.LoadFiles(test.parts)
+			if err == nil || !strings.Contains(err.Error(), test.key+" is required") {
+				t.Fatalf("error %v, want %s to be required", err, test.key)
+			}
+
+			// The values of the parts the command doesn't run are not required
+			if err := c.LoadFiles((PartBot | PartAi | PartAmqp) &^ test.parts); err != nil {
+				t.Fatalf("error %v without %s", err, test.key)
+			}
+		})
+	}
+}
+
+func TestRequiredValuesTogether(t *testing.T) {
+	for _, key := range []string{"BOT_TOKEN", "GPT_TOKEN", "BROKER_URL", "AI_BASE_URL"} {
+		unsetenv(t, key)
+	}
+	t.Setenv("AI_PROVIDER", "openai")
+
+	var c Config
+	err := c.LoadFiles(PartBot | PartAi | PartAmqp)
+	if err == nil {
+		t.Fatal("no error without the required values")
+	}
+	for _, key := range []string{"BOT_TOKEN", "GPT_TOKEN", "BROKER_URL"} {
+		if !strings.Contains(err.Error(), key+" is required") {
+			t.Errorf("error %v doesn't report %s", err, key)
+		}
+	}
+
+	// A self-hosted endpoint may work without a key, the AI service still downloads the files with the bot token
+	t.Setenv("AI_BASE_URL", "http://localhost:8000/v1")
+	err = c.LoadFiles(PartAi)
+	if err == nil || !strings.Contains(err.Error(), "BOT_TOKEN is required") || strings.Contains(err.Error(), "GPT_TOKEN") {
+		t.Fatalf("error %v, want only BOT_TOKEN to be required", err)
+	}
+	t.Setenv("BOT_TOKEN", "token")
+	if err := c.LoadFiles(PartAi); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverrideOrder(t *testing.T) {
+	dir := t.TempDir()
+	cfg := writeFile(t, dir, ".cfg", "AI_MODEL=cfg-model\nAI_CITY=Paris\nAI_WORKERS=2\n")
+	env := writeFile(t, dir, ".env", "AI_CITY=Berlin\nAI_WORKERS=3\n")
+	for _, key := range []string{"AI_MODEL", "AI_CITY", "AI_TEMPERATURE"} {
+		unsetenv(t, key)
+	}
+	t.Setenv("AI_WORKERS", "4")
+
+	var c Config
+	if err := c.LoadFiles(0, cfg, env, filepath.Join(dir, "missing")); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Ai.Model != "cfg-model" {
+		t.Errorf("model %s, want the value of the cfg file", c.Ai.Model)
+	}
+	if c.Ai.City != "Berlin" {
+		t.Errorf("city %s, want the value of the .env file", c.Ai.City)
+	}
+	if c.Ai.Workers != 4 {
+		t.Errorf("workers %d, want the value of the environment", c.Ai.Workers)
+	}
+	if c.Ai.Temperature != 0 {
+		t.Errorf("temperature %v, want the default", c.Ai.Temperature)
+	}
+}
+
+func TestBadFile(t *testing.T) {
+	var c Config
+	err := c.LoadFiles(0, t.TempDir())
+	if err == nil || !strings.HasPrefix(err.Error(), "config: ") {
+		t.Fatalf("error %v, want the file to be reported", err)
+	}
+}
@@ -0,0 +1,130 @@
+package config
+
+import "time"
+
+// Config is the configuration of all services, loaded once at start
+type Config struct {
+	Broker Broker
+	Bot    Bot
+	Ai     Ai
+	Db     Db
+	Log    Log
+	Health Health
+	// LimitsFile contains the request limits of the users, see cfg/limits.json
+	LimitsFile string
+	// ShutdownTimeout is how long the services finish the running requests after SIGTERM, a second signal
+	// stops them at once. It defaults to AI_TIMEOUT_SEC + 30s, 150s with the defaults, the retries of a request fit
+	// into AI_TIMEOUT_SEC. The orchestrator must wait longer before killing the process, e.g. Kubernetes waits
+	// only 30s unless terminationGracePeriodSeconds is raised, otherwise the requests are cut and redelivered
+	ShutdownTimeout time.Duration
+}
+
+// Part is a set of services the command runs, their required values are checked by Load
+type Part int
+
+const (
+	PartBot Part = 1 << iota
+	PartAi
+	PartAmqp
+)
+
+// Broker holds the RabbitMQ settings
+type Broker struct {
+	Url               string
+	MaxRetries        int
+	ConsumerExclusive bool
+	ConsumerNoLocal   bool
+	ConsumerNoWait    bool
+}
+
+// Bot holds the telegram bot settings
+type Bot struct {
+	// Token is required by the AI service too, it downloads the photos and the voice messages from telegram
+	Token string
+	// ReplyTimeout is how long the user waits for the answer before being told there is none,
+	// by default it is AI_TIMEOUT_SEC of one attempt with a margin, so AI_TIMEOUT_SEC must be the same
+	// as the AI service has. A redelivered request answered later is dropped, raise it to wait for the redeliveries
+	ReplyTimeout time.Duration
+	// Mode is 'polling' or 'webhook'
+	Mode              string
+	WebhookUrl        string
+	WebhookListen     string
+	WebhookSecret     string
+	WebhookCert       string
+	WebhookKey        string
+	WebhookUploadCert bool
+	UpdateWorkers     int
+	SenderWorkers     int
+	QueueDepth        int
+	// VoiceMaxDuration limits the voice messages sent for transcription
+	VoiceMaxDuration time.Duration
+	// MetricsListen is the address of the /metrics, /healthz and /readyz pages, empty disables them
+	MetricsListen string
+}
+
+// Ai holds the chat model settings
+type Ai struct {
+	Token string
+	// Provider is 'openai' or 'mock'
+	Provider      string
+	BaseURL       string
+	MockScript    string
+	Model         string
+	Temperature   float32
+	MaxTokens     int
+	HistoryTokens int
+	PromptFile    string
+	// City is the city the guide is set up for, the users are assumed to be there until they share a location
+	City           string
+	StreamInterval time.Duration
+	Timeout        time.Duration
+	Workers        int
+	MaxRetries     int
+	// Transcriber is 'whisper' or 'stub', empty means 'stub' for the mock provider and 'whisper' otherwise
+	Transcriber string
+	// TranscribeURL is the base url of the Whisper-compatible endpoint, empty means the one of the provider
+	TranscribeURL   string
+	TranscribeModel string
+	// StubTranscript is the text the stub transcriber recognizes in any audio
+	StubTranscript string
+	// VisionModel answers the questions about photos, it must accept images
+	VisionModel string
+	// MetricsListen is the address of the /metrics, /healthz and /readyz pages, empty disables them
+	MetricsListen string
+}
+
+// Db holds the PostgreSQL settings, the database is not used if Host is empty
+type Db struct {
+	Host            string
+	Port            string
+	User            string
+	Password        string
+	Name            string
+	SslMode         string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// Log holds the logging settings
+type Log struct {
+	// Format is 'logfmt' or 'json'
+	Format string
+	// Level is the lowest level written: 'debug', 'info' or 'error'
+	Level      string
+	Stdout     bool
+	MaxSizeMb  int
+	MaxAgeDays int
+}
+
+// Health holds the settings of the /readyz page
+type Health struct {
+	// Timeout limits each check, e.g. the telegram getMe request
+	Timeout time.Duration
+}
+
+// source is the merged set of raw values, the later sources override the earlier ones
+type source struct {
+	values map[string]string
+	errs   []string
+}
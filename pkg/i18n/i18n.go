@@ -0,0 +1,109 @@
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DefaultLanguage is used when the user language is unknown, FallbackLanguage when it is not supported
+const (
+	DefaultLanguage  = "ru"
+	FallbackLanguage = "en"
+)
+
+// The file name of a locale is the language code, e.g. 'en.json'
+//
+//go:embed locales/*.json
+var locales embed.FS
+
+// NewCatalog loads the embedded locales, every language must have all the texts of the default one
+func (c *Catalog) NewCatalog() error {
+	files, err := locales.ReadDir("locales")
+	if err != nil {
+		return err
+	}
+
+	c.texts = make(map[string]map[Key]string)
+	for _, file := range files {
+		data, err := locales.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			return err
+		}
+
+		var texts map[Key]string
+		err = json.Unmarshal(data, &texts)
+		if err != nil {
+			return errors.New("i18n: " + file.Name() + ": " + err.Error())
+		}
+		lang := strings.TrimSuffix(file.Name(), ".json")
+		c.texts[lang] = texts
+		c.langs = append(c.langs, lang)
+	}
+	sort.Strings(c.langs)
+
+	defaults, ok := c.texts[DefaultLanguage]
+	if !ok {
+		return errors.New("i18n: no locale of the default language " + DefaultLanguage)
+	}
+	for lang, texts := range c.texts {
+		for key := range defaults {
+			if _, ok := texts[key]; !ok {
+				return errors.New("i18n: " + lang + ": text '" + string(key) + "' is missing")
+			}
+		}
+	}
+
+	return nil
+}
+
+// Languages returns the codes of the supported languages in alphabetical order
+func (c *Catalog) Languages() []string {
+	return c.langs
+}
+
+// Supported reports whether the catalog has the texts of the language
+func (c *Catalog) Supported(lang string) bool {
+	_, ok := c.texts[lang]
+	return ok
+}
+
+// Match turns the telegram language_code, e.g. 'en-US', into a supported language:
+// the default one if the code is empty, the fallback one if it is not supported
+func (c *Catalog) Match(code string) string {
+	code = strings.ToLower(code)
+	if i := strings.IndexAny(code, "-_"); i >= 0 {
+		code = code[:i]
+	}
+
+	switch {
+	case code == "":
+		return DefaultLanguage
+	case c.Supported(code):
+		return code
+	}
+
+	return FallbackLanguage
+}
+
+// Text returns the text in the language matched by Match, the arguments fill in its verbs.
+// A missing text is taken from the default language, the key itself is returned as the last resort
+func (c *Catalog) Text(lang string, key Key, args ...interface{}) string {
+	text, ok := c.texts[c.Match(lang)][key]
+	if !ok {
+		text, ok = c.texts[DefaultLanguage][key]
+	}
+	if !ok {
+		return string(key)
+	}
+
+	if len(args) != 0 {
+		return fmt.Sprintf(text, args...)
+	}
+
+	return text
+}
@@ -0,0 +1,98 @@
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	var c Catalog
+	if err := c.NewCatalog(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"en", "en"},
+		{"en-US", "en"},
+		{"EN_gb", "en"},
+		{"ru", "ru"},
+		{"ru-RU", "ru"},
+		{"de", FallbackLanguage},
+		{"pt-br", FallbackLanguage},
+		{"", DefaultLanguage},
+	}
+	for _, test := range tests {
+		if got := c.Match(test.code); got != test.want {
+			t.Errorf("Match(%q) = %q, want %q", test.code, got, test.want)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	var c Catalog
+	if err := c.NewCatalog(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := c.Text("en-US", LanguageName), "English"; got != want {
+		t.Errorf("Text(en-US) = %q, want %q", got, want)
+	}
+	if got, want := c.Text("de", LanguageName), c.Text(FallbackLanguage, LanguageName); got != want {
+		t.Errorf("Text(de) = %q, want the fallback %q", got, want)
+	}
+	if got, want := c.Text("", LanguageName), c.Text(DefaultLanguage, LanguageName); got != want {
+		t.Errorf("Text('') = %q, want the default %q", got, want)
+	}
+	if got := c.Text("en", Key("missing")); got != "missing" {
+		t.Errorf("Text(missing) = %q, want the key", got)
+	}
+	if got, want := c.Text("en", VoiceTooLong, 120), fmt.Sprintf(c.texts["en"][VoiceTooLong], 120); got != want {
+		t.Errorf("Text(%s, 120) = %q, want %q", VoiceTooLong, got, want)
+	}
+}
+
+func TestLocalesHaveSameKeys(t *testing.T) {
+	files, err := locales.ReadDir("locales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("%d locales, want ru and en at least", len(files))
+	}
+
+	keys := make(map[string][]string)
+	for _, file := range files {
+		data, err := locales.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var texts map[string]string
+		if err := json.Unmarshal(data, &texts); err != nil {
+			t.Fatalf("%s: %v", file.Name(), err)
+		}
+		for key := range texts {
+			keys[file.Name()] = append(keys[file.Name()], key)
+		}
+		sort.Strings(keys[file.Name()])
+	}
+
+	want := keys[DefaultLanguage+".json"]
+	for name, got := range keys {
+		if len(got) != len(want) {
+			t.Errorf("%s has %d texts, %s.json has %d", name, len(got), DefaultLanguage, len(want))
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%s: text %q, %s.json has %q", name, got[i], DefaultLanguage, want[i])
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package i18n
+
+// Catalog holds the system texts of the services in every supported language
+type Catalog struct {
+	texts map[string]map[Key]string
+	langs []string
+}
+
+// Key identifies a text of the catalog, the same key is used in all languages
+type Key string
+
+// Texts of the bot
+const (
+	Thinking       Key = "thinking"
+	NoAnswer       Key = "no_answer"
+	UnknownCommand Key = "unknown_command"
+	CommandUsage   Key = "command_usage"
+	StartText      Key = "start_text"
+	HelpHeader     Key = "help_header"
+	ResetDone      Key = "reset_done"
+	ResetFailed    Key = "reset_failed"
+	LanguageSet    Key = "language_set"
+	LanguageUsage  Key = "language_usage"
+	LimitUser      Key = "limit_user"
+	LimitChat      Key = "limit_chat"
+	LimitGlobal    Key = "limit_global"
+	VoiceTooLong   Key = "voice_too_long"
+
+	// Descriptions of the commands in the telegram menu
+	CmdStart    Key = "cmd_start"
+	CmdHelp     Key = "cmd_help"
+	CmdReset    Key = "cmd_reset"
+	CmdLanguage Key = "cmd_language"
+
+	// LanguageName is the name of the language in this language, e.g. 'English'
+	LanguageName Key = "language_name"
+)
+
+// Texts of the AI service
+const (
+	QuotaSpent      Key = "quota_spent"
+	AiUnavailable   Key = "ai_unavailable"
+	AiRateLimit     Key = "ai_rate_limit"
+	AiServerError   Key = "ai_server_error"
+	AiTimeout       Key = "ai_timeout"
+	AiContextLength Key = "ai_context_length"
+	AiMisconfigured Key = "ai_misconfigured"
+	VoiceFailed     Key = "voice_failed"
+	VoiceEmpty      Key = "voice_empty"
+	VoiceRecognized Key = "voice_recognized"
+	PhotoQuestion   Key = "photo_question"
+	PhotoFailed     Key = "photo_failed"
+)
@@ -0,0 +1,106 @@
+package limits
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// NewLimits loads the tiers from the file, the built-in limits are used if it doesn't exist
+func (l *Limits) NewLimits(fileName string) error {
+	*l = builtin()
+
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var loaded Limits
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fileName, err)
+	}
+	err = loaded.validate()
+	if err != nil {
+		return fmt.Errorf("%s: %w", fileName, err)
+	}
+	*l = loaded
+
+	return nil
+}
+
+// Tier returns the limits of the tier, the default tier is used for unknown names
+func (l *Limits) Tier(name string) Tier {
+	tier, ok := l.Tiers[name]
+	if !ok {
+		return l.Tiers[l.Default]
+	}
+
+	return tier
+}
+
+// UserTier returns the name of the tier assigned to the user
+func (l *Limits) UserTier(userId int64) string {
+	name, ok := l.Users[strconv.FormatInt(userId, 10)]
+	if !ok {
+		return l.Default
+	}
+
+	return name
+}
+
+// validate checks that every referenced tier exists and no limit is negative
+func (l *Limits) validate() error {
+	if _, ok := l.Tiers[l.Default]; !ok {
+		return errors.New("default tier '" + l.Default + "' is not defined")
+	}
+	if l.GlobalRate < 0 || l.GlobalBurst < 0 {
+		return errors.New("global limits must not be negative")
+	}
+	if l.GlobalRate > 0 && l.GlobalBurst < 1 {
+		return errors.New("global_burst must be at least 1 when global_rate is set")
+	}
+
+	for name, tier := range l.Tiers {
+		if tier.UserRate < 0 || tier.UserBurst < 0 || tier.ChatRate < 0 || tier.ChatBurst < 0 || tier.DailyTokens < 0 {
+			return errors.New("limits of tier '" + name + "' must not be negative")
+		}
+		// A bucket smaller than one request would reject everything
+		if (tier.UserRate > 0 && tier.UserBurst < 1) || (tier.ChatRate > 0 && tier.ChatBurst < 1) {
+			return errors.New("bursts of tier '" + name + "' must be at least 1 when the rates are set")
+		}
+	}
+
+	for user, name := range l.Users {
+		if _, err := strconv.ParseInt(user, 10, 64); err != nil {
+			return errors.New("user id '" + user + "' is not a number")
+		}
+		if _, ok := l.Tiers[name]; !ok {
+			return errors.New("tier '" + name + "' of user " + user + " is not defined")
+		}
+	}
+
+	return nil
+}
+
+// builtin returns the limits used without a configuration file
+func builtin() Limits {
+	return Limits{
+		Default:     "free",
+		GlobalRate:  120,
+		GlobalBurst: 20,
+		Tiers: map[string]Tier{
+			"free": {
+				UserRate:    5,
+				UserBurst:   3,
+				ChatRate:    10,
+				ChatBurst:   5,
+				DailyTokens: 50000,
+			},
+		},
+	}
+}
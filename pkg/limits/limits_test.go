@@ -0,0 +1,93 @@
+package limits
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeLimits writes the configuration to a temporary file and returns its name
+func writeLimits(t *testing.T, data string) string {
+	fileName := filepath.Join(t.TempDir(), "limits.json")
+	if err := os.WriteFile(fileName, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return fileName
+}
+
+func TestNewLimitsBuiltin(t *testing.T) {
+	var l Limits
+	if err := l.NewLimits(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Default != "free" || l.Tier("free").UserBurst == 0 {
+		t.Errorf("limits = %+v, want the built-in ones", l)
+	}
+}
+
+func TestNewLimitsFile(t *testing.T) {
+	var l Limits
+	err := l.NewLimits(writeLimits(t, `{
+		"default": "free",
+		"global_rate": 60,
+		"global_burst": 10,
+		"tiers": {
+			"free": {"user_rate": 2, "user_burst": 1, "daily_tokens": 1000},
+			"pro": {"user_rate": 20, "user_burst": 5}
+		},
+		"users": {"42": "pro"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := l.UserTier(42); got != "pro" {
+		t.Errorf("UserTier(42) = %s, want pro", got)
+	}
+	if got := l.UserTier(7); got != "free" {
+		t.Errorf("UserTier(7) = %s, want free", got)
+	}
+	if got := l.Tier("pro").UserRate; got != 20 {
+		t.Errorf("rate of pro = %v, want 20", got)
+	}
+	// Unknown tiers fall back to the default one
+	if got := l.Tier("gold").DailyTokens; got != 1000 {
+		t.Errorf("daily tokens of gold = %d, want 1000", got)
+	}
+}
+
+func TestNewLimitsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"not json", `{"default":`, "unexpected end"},
+		{"missing default tier", `{"default": "free", "tiers": {}}`, "default tier 'free' is not defined"},
+		{"negative global", `{"default": "free", "global_rate": -1, "tiers": {"free": {}}}`, "global limits must not be negative"},
+		{"global without burst", `{"default": "free", "global_rate": 5, "tiers": {"free": {}}}`, "global_burst must be at least 1"},
+		{"negative tier", `{"default": "free", "tiers": {"free": {"daily_tokens": -1}}}`, "tier 'free' must not be negative"},
+		{"rate without burst", `{"default": "free", "tiers": {"free": {"chat_rate": 5}}}`, "bursts of tier 'free' must be at least 1"},
+		{"user id", `{"default": "free", "tiers": {"free": {}}, "users": {"bob": "free"}}`, "user id 'bob' is not a number"},
+		{"user tier", `{"default": "free", "tiers": {"free": {}}, "users": {"42": "pro"}}`, "tier 'pro' of user 42 is not defined"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var l Limits
+			fileName := writeLimits(t, test.data)
+
+			err := l.NewLimits(fileName)
+			if err == nil || !strings.Contains(err.Error(), test.want) || !strings.Contains(err.Error(), fileName) {
+				t.Fatalf("NewLimits() error = %v, want %q", err, test.want)
+			}
+			// The built-in limits stay in force
+			if l.Default != "free" || l.GlobalRate != 120 {
+				t.Errorf("limits = %+v, want the built-in ones", l)
+			}
+		})
+	}
+}
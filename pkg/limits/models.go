@@ -0,0 +1,24 @@
+package limits
+
+// Limits are the request limits of the users, shared by the bot and the AI service.
+// The bot enforces the request rates, the AI service enforces the daily token quota
+type Limits struct {
+	// Default is the tier of the users that are not listed in Users
+	Default string `json:"default"`
+	// GlobalRate and GlobalBurst cap the requests of all users together
+	GlobalRate  float64         `json:"global_rate"`
+	GlobalBurst int             `json:"global_burst"`
+	Tiers       map[string]Tier `json:"tiers"`
+	// Users maps telegram user ids to tier names
+	Users map[string]string `json:"users"`
+}
+
+// Tier is a set of limits assigned to a group of users.
+// Rates are requests per minute, zero rates and DailyTokens mean no limit
+type Tier struct {
+	UserRate    float64 `json:"user_rate"`
+	UserBurst   int     `json:"user_burst"`
+	ChatRate    float64 `json:"chat_rate"`
+	ChatBurst   int     `json:"chat_burst"`
+	DailyTokens int     `json:"daily_tokens"`
+}
@@ -3,41 +3,210 @@ package logging
 // Ivan Orshak, 12.07.2023
 
 import (
-	"log"
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"os"
+	"pocket_guide/pkg/config"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-// NewLog creates a logging system that writes to a file,
-// the path to which is passed as a parameter.
-// Three logging options are implemented:
-// useful information output,
-// error notification
-// and fatal errors notification
+var (
+	// mu guards options and files
+	mu      sync.Mutex
+	options = Options{Format: "logfmt", Level: LevelInfo, MaxSize: 100 << 20, MaxAge: 7 * 24 * time.Hour}
+	files   = make(map[string]*rotator)
+)
+
+// Setup applies the logging settings to all loggers of the process,
+// it is called once at start when the configuration has been loaded
+func Setup(cfg config.Log) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	options = Options{
+		Format:  cfg.Format,
+		Level:   parseLevel(cfg.Level),
+		Stdout:  cfg.Stdout,
+		MaxSize: int64(cfg.MaxSizeMb) << 20,
+		MaxAge:  time.Duration(cfg.MaxAgeDays) * 24 * time.Hour,
+	}
+}
+
+// NewLog creates a logging system that writes to files in the directory,
+// the path to which is passed as a parameter. A new file is started every day
+// and when the current one exceeds the size limit, the old ones are removed after the retention period.
+// Records are written with Debug, Info, Error and Fatal, the key-value pairs after the message
+// become the fields of the record
 func (l *Log) NewLog(fileName string) {
+	mu.Lock()
+	file, ok := files[fileName]
+	if !ok {
+		file = &rotator{prefix: fileName}
+		files[fileName] = file
+	}
+	file.refs++
+	mu.Unlock()
+
+	l.file = file
+	l.fields = nil
+}
+
+// Close closes the file for logging when the last logger writing to it is closed
+func (l *Log) Close() {
+	if l.file == nil {
+		return
+	}
+
+	mu.Lock()
+	l.file.refs--
+	last := l.file.refs == 0
+	if last {
+		delete(files, l.file.prefix)
+	}
+	mu.Unlock()
+
+	if last {
+		err := l.file.close()
+		if err != nil {
+			// The file is closed, so the record goes to stdout
+			l.Error("Close(): Unable to close log file", "err", err)
+		}
+	}
+}
+
+// With returns a logger adding the key-value pairs to every record, e.g.
+// l.With("chat_id", chatId, "correlation_id", id). It shares the file with l and must not be closed
+func (l *Log) With(keyValues ...interface{}) Log {
+	child := Log{file: l.file}
+	child.fields = append(append(child.fields, l.fields...), keyValues...)
+
+	return child
+}
+
+// Debug writes a record with the details useful only while looking into a problem
+func (l *Log) Debug(msg string, keyValues ...interface{}) {
+	l.write(LevelDebug, msg, keyValues)
+}
+
+// Info writes a record about the normal work of the service
+func (l *Log) Info(msg string, keyValues ...interface{}) {
+	l.write(LevelInfo, msg, keyValues)
+}
+
+// Error writes a record about a failure
+func (l *Log) Error(msg string, keyValues ...interface{}) {
+	l.write(LevelError, msg, keyValues)
+}
+
+// Fatal writes a record about a failure the service can't work after and exits
+func (l *Log) Fatal(msg string, keyValues ...interface{}) {
+	l.write(LevelFatal, msg, keyValues)
+	os.Exit(1)
+}
+
+// write formats the record and sends it to the file and to stdout
+func (l *Log) write(level Level, msg string, keyValues []interface{}) {
+	mu.Lock()
+	opts := options
+	mu.Unlock()
+
+	if level < opts.Level {
+		return
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(append(fields, l.fields...), keyValues...)
+	record := format(opts.Format, time.Now(), level, msg, fields)
+
 	var err error
+	if l.file != nil {
+		err = l.file.write(record, opts)
+	}
+	// Records are never lost: stdout is used if the file is not available
+	if opts.Stdout || l.file == nil || err != nil {
+		os.Stdout.Write(record)
+	}
+}
 
-	l.logFile, err = os.OpenFile(fileName+time.Now().Format("01-02-2006")+".log", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
-	if err != nil {
-		log.Println("NewLog(): Unable to open or create file for logs!", err)
+// format builds one line of the record in logfmt or json
+func format(kind string, now time.Time, level Level, msg string, fields []interface{}) []byte {
+	if len(fields)%2 != 0 {
+		fields = append(fields[:len(fields)-1], "!BADKEY", fields[len(fields)-1])
+	}
 
-		l.LogInfo = log.New(os.Stdout, "INFO:\t", log.Ldate|log.Ltime)
-		l.LogErr = log.New(os.Stdout, "ERROR:\t", log.Ldate|log.Ltime)
-		l.LogFatal = log.New(os.Stdout, "FATAL ERROR:\t", log.Ldate|log.Ltime)
-	} else {
-		l.LogInfo = log.New(l.logFile, "INFO:\t", log.Ldate|log.Ltime)
-		l.LogErr = log.New(l.logFile, "ERROR:\t", log.Ldate|log.Ltime)
-		l.LogFatal = log.New(l.logFile, "FATAL ERROR:\t", log.Ldate|log.Ltime)
+	var buf bytes.Buffer
+	if kind == "json" {
+		buf.WriteString(`{"time":"` + now.Format(time.RFC3339Nano) + `","level":"` + level.String() + `","msg":`)
+		buf.Write(jsonValue(msg))
+		for i := 0; i < len(fields); i += 2 {
+			buf.WriteByte(',')
+			buf.Write(jsonValue(fmt.Sprint(fields[i])))
+			buf.WriteByte(':')
+			buf.Write(jsonValue(fields[i+1]))
+		}
+		buf.WriteString("}\n")
+
+		return buf.Bytes()
 	}
+
+	buf.WriteString("time=" + now.Format(time.RFC3339Nano) + " level=" + level.String() + " msg=" + logfmtValue(msg))
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteString(" " + fmt.Sprint(fields[i]) + "=" + logfmtValue(fields[i+1]))
+	}
+	buf.WriteByte('\n')
+
+	return buf.Bytes()
 }
 
-// Close closes the file for logging
-func (l *Log) Close() {
-	err := l.logFile.Close()
+// jsonValue encodes the value, errors and values json can't encode are written as strings.
+// fmt prints the nil errors of the pointer types instead of calling their methods
+func jsonValue(value interface{}) []byte {
+	if err, ok := value.(error); ok {
+		value = fmt.Sprint(err)
+	}
 
+	data, err := json.Marshal(value)
 	if err != nil {
-		l.LogErr.Println("Close(): Unable to close log file, error:", err)
-	} else {
-		l.LogInfo.Println("Close(): Log file has been closed.")
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+
+	return data
+}
+
+// logfmtValue quotes the value if it contains spaces, quotes or '='
+func logfmtValue(value interface{}) string {
+	text := fmt.Sprint(value)
+	if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+		return strconv.Quote(text)
+	}
+
+	return text
+}
+
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelError:
+		return "error"
 	}
+
+	return "fatal"
+}
+
+// parseLevel returns the level by its name, info for unknown names
+func parseLevel(name string) Level {
+	for level := LevelDebug; level <= LevelFatal; level++ {
+		if level.String() == name {
+			return level
+		}
+	}
+
+	return LevelInfo
 }
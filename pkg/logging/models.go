@@ -3,11 +3,49 @@ package logging
 // Ivan Orshak, 12.07.2023
 
 import (
-	"log"
 	"os"
+	"sync"
+	"time"
 )
 
+// Log writes structured records to a rotated file and optionally to stdout
 type Log struct {
-	logFile                   *os.File
-	LogInfo, LogErr, LogFatal *log.Logger
+	file   *rotator
+	fields []interface{}
+}
+
+// Level is the severity of a record
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelError
+	LevelFatal
+)
+
+// Options are the settings shared by all loggers of the process
+type Options struct {
+	// Format is 'logfmt' or 'json'
+	Format string
+	Level  Level
+	Stdout bool
+	// MaxSize is the size of a file in bytes after which the next one is started, zero means no limit
+	MaxSize int64
+	// MaxAge is how long the old files are kept, zero means forever
+	MaxAge time.Duration
+}
+
+// rotator is a log file that is reopened every day and when it grows over the size limit.
+// Loggers writing to the same directory share one rotator
+type rotator struct {
+	mu     sync.Mutex
+	prefix string
+	day    string
+	index  int
+	size   int64
+	file   *os.File
+	refs   int
+	closed bool
+	now    func() time.Time
 }
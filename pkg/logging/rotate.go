@@ -0,0 +1,147 @@
+package logging
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dayFormat is the date part of the log file names
+const dayFormat = "01-02-2006"
+
+// errRotatorClosed is returned for the records written after the last logger of the file has been closed,
+// the file is not reopened for them
+var errRotatorClosed = errors.New("log file has been closed")
+
+// write appends the record to the current file, starting a new one on a new day
+// or when the record doesn't fit into the size limit
+func (r *rotator) write(record []byte, opts Options) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errRotatorClosed
+	}
+
+	day := r.clock().Format(dayFormat)
+	full := opts.MaxSize > 0 && r.size > 0 && r.size+int64(len(record)) > opts.MaxSize
+	if r.file == nil || day != r.day || full {
+		err := r.rotate(day, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := r.file.Write(record)
+	r.size += int64(n)
+
+	return err
+}
+
+// rotate opens the next file of the day: '<day>.log', then '<day>.1.log' and so on.
+// Files left by the previous run are appended to while they have room
+func (r *rotator) rotate(day string, opts Options) error {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	if day != r.day {
+		r.day = day
+		r.index = 0
+	} else {
+		r.index++
+	}
+
+	err := os.MkdirAll(filepath.Dir(r.prefix+day), 0755)
+	if err != nil {
+		return err
+	}
+
+	for {
+		file, err := os.OpenFile(r.name(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if opts.MaxSize == 0 || info.Size() < opts.MaxSize {
+			r.file = file
+			r.size = info.Size()
+			break
+		}
+		file.Close()
+		r.index++
+	}
+
+	r.removeOld(opts.MaxAge)
+
+	return nil
+}
+
+// clock returns the current time, the tests set their own clock
+func (r *rotator) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+
+	return time.Now()
+}
+
+// name returns the path of the current file
+func (r *rotator) name() string {
+	if r.index == 0 {
+		return r.prefix + r.day + ".log"
+	}
+
+	return r.prefix + r.day + "." + strconv.Itoa(r.index) + ".log"
+}
+
+// removeOld deletes the log files that haven't been written to for longer than maxAge
+func (r *rotator) removeOld(maxAge time.Duration) {
+	if maxAge == 0 {
+		return
+	}
+
+	dir, base := filepath.Split(r.prefix)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	current := filepath.Base(r.name())
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == current || !strings.HasPrefix(name, base) || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err == nil && r.clock().Sub(info.ModTime()) > maxAge {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
+
+// close closes the current file, the later records are not written to the files
+func (r *rotator) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+
+	return err
+}
@@ -0,0 +1,153 @@
+package logging
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRotator returns the rotator writing to a temporary directory at the time returned by the clock
+func newTestRotator(t *testing.T, now *time.Time) (*rotator, string) {
+	dir := t.TempDir()
+	r := &rotator{prefix: dir + "/", now: func() time.Time { return *now }}
+	t.Cleanup(func() { r.close() })
+
+	return r, dir
+}
+
+// logFiles returns the names of the files in the directory
+func logFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func TestRotatorSize(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	r, dir := newTestRotator(t, &now)
+	opts := Options{MaxSize: 10}
+
+	for _, record := range []string{"1234\n", "1234\n", "123\n"} {
+		if err := r.write([]byte(record), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second record fills the first file up to the limit, the third one starts the next file
+	want := []string{"10-17-2026.1.log", "10-17-2026.log"}
+	if got := logFiles(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("files %v, want %v", got, want)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "10-17-2026.log"))
+	if string(data) != "1234\n1234\n" {
+		t.Errorf("first file = %q", data)
+	}
+}
+
+func TestRotatorDay(t *testing.T) {
+	now := time.Date(2026, 10, 17, 23, 59, 0, 0, time.UTC)
+	r, dir := newTestRotator(t, &now)
+
+	_ = r.write([]byte("evening\n"), Options{})
+	now = now.Add(2 * time.Minute)
+	_ = r.write([]byte("morning\n"), Options{})
+
+	want := []string{"10-17-2026.log", "10-18-2026.log"}
+	if got := logFiles(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("files %v, want %v", got, want)
+	}
+}
+
+func TestRotatorAppendsAfterRestart(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	r, dir := newTestRotator(t, &now)
+	opts := Options{MaxSize: 10}
+	_ = r.write([]byte("123456789\n"), opts)
+	_ = r.write([]byte("12\n"), opts)
+	r.close()
+
+	// The full file is skipped, the one with room is appended to
+	next := &rotator{prefix: dir + "/", now: r.now}
+	defer next.close()
+	_ = next.write([]byte("34\n"), opts)
+
+	data, _ := os.ReadFile(filepath.Join(dir, "10-17-2026.1.log"))
+	if string(data) != "12\n34\n" {
+		t.Errorf("second file = %q", data)
+	}
+}
+
+func TestRotatorRetention(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	r, dir := newTestRotator(t, &now)
+
+	for name, age := range map[string]time.Duration{
+		"10-01-2026.log": 16 * 24 * time.Hour,
+		"10-15-2026.log": 2 * 24 * time.Hour,
+		"notes.txt":      30 * 24 * time.Hour,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("old\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_ = r.write([]byte("new\n"), Options{MaxAge: 7 * 24 * time.Hour})
+
+	want := []string{"10-15-2026.log", "10-17-2026.log", "notes.txt"}
+	if got := logFiles(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("files %v, want %v", got, want)
+	}
+}
+
+func TestRotatorClosed(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	r, dir := newTestRotator(t, &now)
+	_ = r.write([]byte("before\n"), Options{})
+	r.close()
+
+	if err := r.write([]byte("after\n"), Options{}); !errors.Is(err, errRotatorClosed) {
+		t.Errorf("write() error = %v, want errRotatorClosed", err)
+	}
+	if r.file != nil {
+		t.Error("the file has been reopened after close")
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "10-17-2026.log"))
+	if string(data) != "before\n" {
+		t.Errorf("file = %q", data)
+	}
+}
+
+func TestFormatErrField(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	err := errors.New("connection refused")
+
+	got := string(format("logfmt", now, LevelError, "Connect(): Unable to connect", []interface{}{"err", err}))
+	want := `time=2026-10-17T12:00:00Z level=error msg="Connect(): Unable to connect" err="connection refused"` + "\n"
+	if got != want {
+		t.Errorf("logfmt = %s, want %s", got, want)
+	}
+
+	var nilErr *os.PathError
+	got = string(format("json", now, LevelError, "Connect(): Unable to connect", []interface{}{"err", err, "reason", nilErr}))
+	want = `{"time":"2026-10-17T12:00:00Z","level":"error","msg":"Connect(): Unable to connect",` +
+		`"err":"connection refused","reason":"\u003cnil\u003e"}` + "\n"
+	if got != want {
+		t.Errorf("json = %s, want %s", got, want)
+	}
+}
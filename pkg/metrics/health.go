@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health adds the /healthz and /readyz pages, the checks are run by /readyz, each of them is limited by the timeout.
+// /healthz only shows that the process serves requests, an orchestrator restarts the process if it fails.
+// None of the dependencies is checked by it: the broker is reconnected by the process itself
+// and the remote services don't get better after a restart, so their failures only take the service
+// out of rotation. /readyz fails if any check fails or the service is not ready, no work should be routed to it then.
+// Checks with the same name are run once, e.g. the broker shared by two services
+func (s *Server) Health(timeout time.Duration, checks ...Check) {
+	s.timeout = timeout
+	names := make(map[string]bool)
+	for _, check := range checks {
+		if !names[check.Name] {
+			names[check.Name] = true
+			s.checks = append(s.checks, check)
+		}
+	}
+
+	s.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		write(w, http.StatusOK, "service: ok\n")
+	})
+	s.mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		s.report(w, r.Context())
+	})
+}
+
+// SetReady marks the service as able to handle requests, it is cleared on shutdown
+// so the traffic is moved away before the service stops
+func (s *Server) SetReady(ready bool) {
+	var value int32
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&s.ready, value)
+}
+
+// report runs the checks concurrently and writes one line per check,
+// the status is 503 if any of them has failed
+func (s *Server) report(w http.ResponseWriter, ctx context.Context) {
+	results := make([]error, len(s.checks))
+	var wg sync.WaitGroup
+	for i, check := range s.checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = s.run(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	var page strings.Builder
+	status := http.StatusOK
+	if atomic.LoadInt32(&s.ready) == 0 {
+		status = http.StatusServiceUnavailable
+		page.WriteString("service: not ready\n")
+	}
+	for i, check := range s.checks {
+		if results[i] != nil {
+			status = http.StatusServiceUnavailable
+			page.WriteString(check.Name + ": " + results[i].Error() + "\n")
+		} else {
+			page.WriteString(check.Name + ": ok\n")
+		}
+	}
+
+	write(w, status, page.String())
+}
+
+// write sends the plain text page, the probes must never get a cached one
+func write(w http.ResponseWriter, status int, page string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(page))
+}
+
+// run calls the check with the timeout, a check that ignores the context is abandoned when it expires
+func (s *Server) run(ctx context.Context, check Check) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- check.Run(ctx)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
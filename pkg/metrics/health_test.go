@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthPages(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	failed := func(ctx context.Context) error { return errors.New("connection refused") }
+	hanging := func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}
+
+	tests := []struct {
+		name        string
+		ready       bool
+		run         func(ctx context.Context) error
+		wantHealthz int
+		wantReadyz  int
+	}{
+		{name: "ready", ready: true, run: ok, wantHealthz: 200, wantReadyz: 200},
+		{name: "not ready", ready: false, run: ok, wantHealthz: 200, wantReadyz: 503},
+		{name: "failed check", ready: true, run: failed, wantHealthz: 200, wantReadyz: 503},
+		{name: "check timeout", ready: true, run: hanging, wantHealthz: 200, wantReadyz: 503},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var s Server
+			s.NewServer("127.0.0.1:0")
+			// The broker shared by two services is checked once
+			s.Health(50*time.Millisecond, Check{Name: "broker", Run: test.run}, Check{Name: "broker", Run: failed})
+			s.SetReady(test.ready)
+
+			for page, want := range map[string]int{"/healthz": test.wantHealthz, "/readyz": test.wantReadyz} {
+				recorder := httptest.NewRecorder()
+				s.mux.ServeHTTP(recorder, httptest.NewRequest("GET", page, nil))
+				if recorder.Code != want {
+					t.Errorf("%s status = %d, want %d:\n%s", page, recorder.Code, want, recorder.Body.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Server is the HTTP server of the service metrics and health, /metrics is always served,
+// the health pages are added by Health()
+type Server struct {
+	mux    *http.ServeMux
+	server *http.Server
+	checks []Check
+	// timeout limits each check of the health pages
+	timeout time.Duration
+	// ready is set by SetReady, read and written atomically
+	ready int32
+}
+
+// Check is a probe of a dependency of the service, Run returns nil if the dependency works
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewServer prepares the server listening on the address, e.g. ':9090'
+func (s *Server) NewServer(addr string) {
+	s.mux = http.NewServeMux()
+	s.mux.Handle("/metrics", promhttp.Handler())
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// Start opens the port and serves the pages in the background,
+// the errors after the port has been opened are passed to onError
+func (s *Server) Start(onError func(err error)) error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			onError(err)
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown stops the server, waiting for the running requests until the context expires.
+// A server that has not been created is ignored
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,22 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerMetrics(t *testing.T) {
+	var s Server
+	s.NewServer("127.0.0.1:0")
+
+	recorder := httptest.NewRecorder()
+	s.mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if recorder.Code != 200 {
+		t.Fatalf("status = %d", recorder.Code)
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, "# TYPE go_goroutines gauge\n") {
+		t.Errorf("page has no go_goroutines:\n%s", body)
+	}
+}
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS chat_locations (
+    chat_id    BIGINT PRIMARY KEY,
+    latitude   DOUBLE PRECISION NOT NULL,
+    longitude  DOUBLE PRECISION NOT NULL,
+    title      TEXT NOT NULL DEFAULT '',
+    address    TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
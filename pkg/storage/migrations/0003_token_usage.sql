@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS token_usage (
+    user_id BIGINT NOT NULL,
+    day     DATE NOT NULL,
+    tokens  BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, day)
+);
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"database/sql"
+	"pocket_guide/pkg/logging"
+	"time"
+)
+
+type Storage struct {
+	db        *sql.DB
+	Users     UserRepo
+	Chats     ChatRepo
+	Messages  MessageRepo
+	Locations LocationRepo
+	Usage     UsageRepo
+	log       logging.Log
+	err       error
+}
+
+// UserRepo stores telegram users
+type UserRepo struct {
+	db *sql.DB
+}
+
+// ChatRepo stores telegram chats
+type ChatRepo struct {
+	db *sql.DB
+}
+
+// MessageRepo stores the conversation history of the chats
+type MessageRepo struct {
+	db *sql.DB
+}
+
+// LocationRepo stores the last location shared in each chat
+type LocationRepo struct {
+	db *sql.DB
+}
+
+// UsageRepo stores the number of AI tokens spent by each user per day
+type UsageRepo struct {
+	db *sql.DB
+}
+
+type User struct {
+	Id           int64
+	UserName     string
+	FirstName    string
+	LastName     string
+	LanguageCode string
+	// Language is the reply language chosen by the user, empty means LanguageCode is used
+	Language  string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type Chat struct {
+	Id        int64
+	Type      string
+	Title     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Message is one turn of a conversation, Role is "user" or "assistant"
+type Message struct {
+	Id        int64
+	ChatId    int64
+	UserId    int64
+	Role      string
+	Content   string
+	CreatedAt time.Time
+}
+
+// Location is the last point shared in the chat, Title and Address are set for venues
+type Location struct {
+	ChatId    int64
+	Latitude  float64
+	Longitude float64
+	Title     string
+	Address   string
+	UpdatedAt time.Time
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned when the requested record doesn't exist
+var ErrNotFound = errors.New("storage: record not found")
+
+// Save creates the user or updates its profile fields
+func (r *UserRepo) Save(ctx context.Context, u User) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO users (id, username, first_name, last_name, language_code)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE SET
+			username = EXCLUDED.username,
+			first_name = EXCLUDED.first_name,
+			last_name = EXCLUDED.last_name,
+			language_code = EXCLUDED.language_code,
+			updated_at = now()`,
+		u.Id, u.UserName, u.FirstName, u.LastName, u.LanguageCode)
+
+	return err
+}
+
+// Get returns the user by its telegram id
+func (r *UserRepo) Get(ctx context.Context, id int64) (User, error) {
+	var u User
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, username, first_name, last_name, language_code, language, created_at, updated_at
+		FROM users WHERE id = $1`, id).
+		Scan(&u.Id, &u.UserName, &u.FirstName, &u.LastName, &u.LanguageCode, &u.Language, &u.CreatedAt, &u.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, ErrNotFound
+	}
+
+	return u, err
+}
+
+// SetLanguage stores the reply language chosen by the user, the user is created if it doesn't exist
+func (r *UserRepo) SetLanguage(ctx context.Context, id int64, language string) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO users (id, language)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET
+			language = EXCLUDED.language,
+			updated_at = now()`,
+		id, language)
+
+	return err
+}
+
+// Save creates the chat or updates its type and title
+func (r *ChatRepo) Save(ctx context.Context, c Chat) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO chats (id, type, title)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET
+			type = EXCLUDED.type,
+			title = EXCLUDED.title,
+			updated_at = now()`,
+		c.Id, c.Type, c.Title)
+
+	return err
+}
+
+// Get returns the chat by its telegram id
+func (r *ChatRepo) Get(ctx context.Context, id int64) (Chat, error) {
+	var c Chat
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, type, title, created_at, updated_at
+		FROM chats WHERE id = $1`, id).
+		Scan(&c.Id, &c.Type, &c.Title, &c.CreatedAt, &c.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, ErrNotFound
+	}
+
+	return c, err
+}
+
+// Add appends the messages to the chat history in one transaction
+func (r *MessageRepo) Add(ctx context.Context, messages ...Message) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, m := range messages {
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO messages (chat_id, user_id, role, content) VALUES ($1, $2, $3, $4)",
+			m.ChatId, m.UserId, m.Role, m.Content)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Last returns up to limit latest messages of the chat in chronological order
+func (r *MessageRepo) Last(ctx context.Context, chatId int64, limit int) ([]Message, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, chat_id, user_id, role, content, created_at FROM (
+			SELECT * FROM messages WHERE chat_id = $1 ORDER BY id DESC LIMIT $2
+		) last ORDER BY id`, chatId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var m Message
+		err = rows.Scan(&m.Id, &m.ChatId, &m.UserId, &m.Role, &m.Content, &m.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
+
+// DeleteChat removes the whole history of the chat
+func (r *MessageRepo) DeleteChat(ctx context.Context, chatId int64) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM messages WHERE chat_id = $1", chatId)
+
+	return err
+}
+
+// Save replaces the last location of the chat
+func (r *LocationRepo) Save(ctx context.Context, l Location) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO chat_locations (chat_id, latitude, longitude, title, address)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (chat_id) DO UPDATE SET
+			latitude = EXCLUDED.latitude,
+			longitude = EXCLUDED.longitude,
+			title = EXCLUDED.title,
+			address = EXCLUDED.address,
+			updated_at = now()`,
+		l.ChatId, l.Latitude, l.Longitude, l.Title, l.Address)
+
+	return err
+}
+
+// Get returns the last location of the chat
+func (r *LocationRepo) Get(ctx context.Context, chatId int64) (Location, error) {
+	var l Location
+	err := r.db.QueryRowContext(ctx, `
+		SELECT chat_id, latitude, longitude, title, address, updated_at
+		FROM chat_locations WHERE chat_id = $1`, chatId).
+		Scan(&l.ChatId, &l.Latitude, &l.Longitude, &l.Title, &l.Address, &l.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return l, ErrNotFound
+	}
+
+	return l, err
+}
+
+// Add adds the tokens to the usage of the user for the day and returns the new total
+func (r *UsageRepo) Add(ctx context.Context, userId int64, day time.Time, tokens int) (int, error) {
+	var total int
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO token_usage (user_id, day, tokens)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, day) DO UPDATE SET
+			tokens = token_usage.tokens + EXCLUDED.tokens
+		RETURNING tokens`,
+		userId, day.Format("2006-01-02"), tokens).Scan(&total)
+
+	return total, err
+}
+
+// Get returns the tokens spent by the user for the day, zero if there were no requests
+func (r *UsageRepo) Get(ctx context.Context, userId int64, day time.Time) (int, error) {
+	var total int
+	err := r.db.QueryRowContext(ctx,
+		"SELECT tokens FROM token_usage WHERE user_id = $1 AND day = $2",
+		userId, day.Format("2006-01-02")).Scan(&total)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+
+	return total, err
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"pocket_guide/pkg/config"
+	"testing"
+	"time"
+)
+
+// newTestStorage connects to the PostgreSQL server configured by the DB_* variables, the test is skipped without it.
+// The rows of the returned id are removed from all tables at the end of the test
+func newTestStorage(t *testing.T) (*Storage, int64) {
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	var cfg config.Config
+	if err := cfg.LoadFiles(0); err != nil {
+		t.Fatal(err)
+	}
+
+	var s Storage
+	if err := s.NewStorage(cfg.Db); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	// A new id every run, so the rows left by an interrupted run don't matter
+	id := time.Now().UnixNano()
+	t.Cleanup(func() {
+		for _, query := range []string{
+			"DELETE FROM users WHERE id = $1",
+			"DELETE FROM chats WHERE id = $1",
+			"DELETE FROM messages WHERE chat_id = $1 OR chat_id = $1 + 1",
+			"DELETE FROM chat_locations WHERE chat_id = $1",
+			"DELETE FROM token_usage WHERE user_id = $1",
+		} {
+			if _, err := s.db.Exec(query, id); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	return &s, id
+}
+
+func TestUserRepo(t *testing.T) {
+	s, id := newTestStorage(t)
+	ctx := context.Background()
+
+	if _, err := s.Users.Get(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("error %v, want ErrNotFound", err)
+	}
+
+	// /language may come before the first question, the user is created by it
+	if err := s.Users.SetLanguage(ctx, id, "de"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Users.Save(ctx, User{Id: id, UserName: "ivan", FirstName: "Ivan", LanguageCode: "ru"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Users.Save(ctx, User{Id: id, UserName: "ivan_o", FirstName: "Ivan", LanguageCode: "en"}); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.Users.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.UserName != "ivan_o" || u.LanguageCode != "en" {
+		t.Errorf("user %+v, want the last profile", u)
+	}
+	if u.Language != "de" {
+		t.Errorf("language %q, want the chosen one to outlive the profile updates", u.Language)
+	}
+}
+
+func TestChatRepo(t *testing.T) {
+	s, id := newTestStorage(t)
+	ctx := context.Background()
+
+	if _, err := s.Chats.Get(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("error %v, want ErrNotFound", err)
+	}
+	if err := s.Chats.Save(ctx, Chat{Id: id, Type: "group", Title: "Trip"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Chats.Save(ctx, Chat{Id: id, Type: "supergroup", Title: "Trip to London"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s.Chats.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Type != "supergroup" || c.Title != "Trip to London" {
+		t.Errorf("chat %+v, want the last type and title", c)
+	}
+}
+
+func TestMessageRepo(t *testing.T) {
+	s, id := newTestStorage(t)
+	ctx := context.Background()
+
+	err := s.Messages.Add(ctx,
+		Message{ChatId: id, UserId: 1, Role: "user", Content: "1"},
+		Message{ChatId: id, Role: "assistant", Content: "2"},
+		Message{ChatId: id, UserId: 1, Role: "user", Content: "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Messages.Add(ctx, Message{ChatId: id + 1, Role: "user", Content: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Messages.Add(ctx, Message{ChatId: id, Role: "assistant", Content: "4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The latest messages come in the order they were written
+	messages, err := s.Messages.Last(ctx, id, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for _, m := range messages {
+		got += m.Content
+	}
+	if got != "234" {
+		t.Errorf("messages %q, want 234", got)
+	}
+
+	// /reset removes only the history of its chat
+	if err := s.Messages.DeleteChat(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if messages, err := s.Messages.Last(ctx, id, 3); err != nil || len(messages) != 0 {
+		t.Errorf("messages %v, error %v after DeleteChat(), want none", messages, err)
+	}
+	if messages, err := s.Messages.Last(ctx, id+1, 3); err != nil || len(messages) != 1 {
+		t.Errorf("messages %v, error %v of the other chat, want one", messages, err)
+	}
+}
+
+func TestLocationRepo(t *testing.T) {
+	s, id := newTestStorage(t)
+	ctx := context.Background()
+
+	if _, err := s.Locations.Get(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("error %v, want ErrNotFound", err)
+	}
+	if err := s.Locations.Save(ctx, Location{ChatId: id, Latitude: 51.5, Longitude: -0.12}); err != nil {
+		t.Fatal(err)
+	}
+	venue := Location{ChatId: id, Latitude: 51.5007, Longitude: -0.1246, Title: "Big Ben", Address: "London SW1A 0AA"}
+	if err := s.Locations.Save(ctx, venue); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := s.Locations.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Latitude != venue.Latitude || l.Longitude != venue.Longitude || l.Title != venue.Title || l.Address != venue.Address {
+		t.Errorf("location %+v, want the last one %+v", l, venue)
+	}
+}
+
+func TestUsageRepo(t *testing.T) {
+	s, id := newTestStorage(t)
+	ctx := context.Background()
+	today := time.Date(2026, 10, 17, 23, 30, 0, 0, time.UTC)
+	tomorrow := today.Add(time.Hour)
+
+	if total, err := s.Usage.Get(ctx, id, today); err != nil || total != 0 {
+		t.Fatalf("usage %d, error %v without requests, want 0", total, err)
+	}
+
+	// The total is returned by the same statement, so concurrent requests see their own sums
+	for _, step := range []struct {
+		day    time.Time
+		tokens int
+		total  int
+	}{
+		{today, 10, 10},
+		{today, 5, 15},
+		{tomorrow, 7, 7},
+	} {
+		total, err := s.Usage.Add(ctx, id, step.day, step.tokens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != step.total {
+			t.Errorf("total %d after adding %d, want %d", total, step.tokens, step.total)
+		}
+	}
+
+	if total, err := s.Usage.Get(ctx, id, today); err != nil || total != 15 {
+		t.Errorf("usage %d, error %v, want 15", total, err)
+	}
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	"pocket_guide/pkg/config"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotConfigured is returned by NewStorage when the database is not configured,
+// services are able to work without persistence in this case
+var ErrNotConfigured = errors.New("storage: DB_HOST is not set")
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// migrationLock is the key of the advisory lock held while the migrations are applied
+const migrationLock int64 = 720231017
+
+// NewStorage is a method that initializes its own logging system,
+// creates a connection pool to the PostgreSQL server,
+// applies schema migrations and creates the repositories
+func (s *Storage) NewStorage(cfg config.Db) error {
+	// Logging layer
+	s.log.NewLog("logs/storage/")
+
+	if !cfg.Enabled() {
+		return ErrNotConfigured
+	}
+
+	// Creating connection pool, sql.Open doesn't connect by itself
+	s.db, s.err = sql.Open("postgres", makeDsn(cfg))
+	if s.err != nil {
+		s.log.Error("NewStorage(): Unable to open database", "err", s.err)
+		return s.err
+	}
+
+	s.db.SetMaxOpenConns(cfg.MaxOpenConns)
+	s.db.SetMaxIdleConns(cfg.MaxIdleConns)
+	s.db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Checking that the server is reachable
+	s.err = s.db.PingContext(ctx)
+	if s.err != nil {
+		s.log.Error("NewStorage(): Unable to connect to database", "err", s.err)
+		return s.err
+	} else {
+		s.log.Info("NewStorage(): Connected to database", "database", cfg.Name)
+	}
+
+	// Bringing the schema up to date
+	s.err = s.migrate(ctx)
+	if s.err != nil {
+		s.log.Error("NewStorage(): Unable to apply migrations", "err", s.err)
+		return s.err
+	}
+
+	s.Users.db = s.db
+	s.Chats.db = s.db
+	s.Messages.db = s.db
+	s.Locations.db = s.db
+	s.Usage.db = s.db
+
+	return nil
+}
+
+// Enabled reports whether the connection pool has been created
+func (s *Storage) Enabled() bool {
+	return s.db != nil
+}
+
+// Close closes the connection pool and the logging system
+func (s *Storage) Close() {
+	defer s.log.Close()
+
+	if s.db == nil {
+		return
+	}
+
+	s.err = s.db.Close()
+	if s.err != nil {
+		s.log.Error("Close(): Unable to close the database", "err", s.err)
+	} else {
+		s.log.Info("Close(): The database was successfully closed")
+	}
+}
+
+// migrate applies embedded migrations that are not yet recorded
+// in the schema_migrations table, each one in its own transaction.
+// The services start together, so the whole run holds an advisory lock
+// and the second one finds the migrations applied by the first
+func (s *Storage) migrate(ctx context.Context) error {
+	// The advisory lock belongs to the session, so everything runs on one connection of the pool
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLock)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// The lock is released even if the context has expired, a failed unlock ends with the session
+		_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLock)
+		if err != nil {
+			s.log.Error("migrate(): Unable to release the migration lock", "err", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+
+	files, err := migrationFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		version := strings.TrimSuffix(file, ".sql")
+
+		var applied bool
+		err = conn.QueryRowContext(ctx,
+			"SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = $1)", version).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		query, err := migrations.ReadFile("migrations/" + file)
+		if err != nil {
+			return err
+		}
+
+		err = applyMigration(ctx, conn, version, string(query))
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", version, err)
+		}
+		s.log.Info("migrate(): Migration has been successfully applied", "version", version)
+	}
+
+	return nil
+}
+
+// migrationFiles returns the names of the embedded migrations in the apply order
+func migrationFiles() ([]string, error) {
+	entries, err := migrations.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		files = append(files, entry.Name())
+	}
+	// File names start with a zero-padded number, so the lexical order is the apply order
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// applyMigration runs one migration and records its version atomically
+func applyMigration(ctx context.Context, conn *sql.Conn, version, query string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// makeDsn builds the PostgreSQL connection string
+func makeDsn(cfg config.Db) string {
+	params := [][2]string{
+		{"host", cfg.Host},
+		{"port", cfg.Port},
+		{"user", cfg.User},
+		{"password", cfg.Password},
+		{"dbname", cfg.Name},
+		{"sslmode", cfg.SslMode},
+	}
+
+	// Values are quoted, so passwords with spaces survive
+	var sb strings.Builder
+	for _, param := range params {
+		if param[1] == "" {
+			continue
+		}
+		value := strings.ReplaceAll(strings.ReplaceAll(param[1], `\`, `\\`), `'`, `\'`)
+		sb.WriteString(param[0] + "='" + value + "' ")
+	}
+
+	return strings.TrimSpace(sb.String())
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"os"
+	"pocket_guide/pkg/config"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMakeDsn(t *testing.T) {
+	dsn := makeDsn(config.Db{
+		Host:     "db",
+		Port:     "5432",
+		User:     "guide",
+		Password: `p a's\s`,
+		Name:     "pocket_guide",
+	})
+
+	want := `host='db' port='5432' user='guide' password='p a\'s\\s' dbname='pocket_guide'`
+	if dsn != want {
+		t.Errorf("makeDsn() = %s, want %s", dsn, want)
+	}
+}
+
+func TestMigrationFiles(t *testing.T) {
+	files, err := migrationFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 || files[0] != "0001_init.sql" {
+		t.Fatalf("migrations %v, want 0001_init.sql first", files)
+	}
+
+	// Two files with the same number would be applied in an unplanned order
+	numbers := make(map[string]string)
+	for _, file := range files {
+		number, _, _ := strings.Cut(file, "_")
+		if other, ok := numbers[number]; ok {
+			t.Errorf("migrations %s and %s have the same number", other, file)
+		}
+		numbers[number] = file
+	}
+}
+
+// TestMigrateConcurrently needs a PostgreSQL server, it is configured by the DB_* variables
+func TestMigrateConcurrently(t *testing.T) {
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	var cfg config.Config
+	if err := cfg.LoadFiles(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bot and the AI service apply the migrations at the same time on the first deploy
+	storages := make([]Storage, 2)
+	errs := make([]error, len(storages))
+	var wg sync.WaitGroup
+	for i := range storages {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = storages[i].NewStorage(cfg.Db)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range storages {
+		defer storages[i].Close()
+		if errs[i] != nil {
+			t.Errorf("NewStorage() %d error = %v", i, errs[i])
+		}
+	}
+}